@@ -4,6 +4,8 @@ go 1.14
 
 require (
 	github.com/axgle/mahonia v0.0.0-20180208002826-3358181d7394
+	github.com/google/uuid v1.0.0
+	github.com/gorilla/mux v1.7.3
 	github.com/gorilla/websocket v1.4.2
 	github.com/ipfs/go-log/v2 v2.1.1
 	github.com/prometheus/common v0.12.0
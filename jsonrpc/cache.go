@@ -0,0 +1,209 @@
+package jsonrpc
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheEntries is the number of responses cached for a method when
+// CacheConfig.MaxEntries isn't set
+const DefaultCacheEntries = 1000
+
+// CacheConfig configures caching of responses of a method, see
+// WithMethodCache and MethodCache. Responses are cached by params, compared
+// as JSON values, so formatting and the order of object keys don't matter.
+// Only successful responses are cached. Concurrent calls with the same params
+// wait for the first one and share its response.
+type CacheConfig struct {
+	// TTL is how long responses are cached, they don't expire when zero
+	TTL time.Duration
+
+	// MaxEntries limits the number of cached responses, the least recently
+	// used ones are dropped first. DefaultCacheEntries when zero.
+	MaxEntries int
+
+	// Principal returns who makes a call, e.g. from values set in the context
+	// by an authentication middleware. When set, responses are cached
+	// separately for each principal.
+	Principal func(ctx context.Context) string
+}
+
+// methodCache caches responses of a method, with an LRU list of entries
+type methodCache struct {
+	config CacheConfig
+
+	lk      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	calls   map[string]*cacheCall
+	// gen changes on invalidation, responses of calls started before are
+	// then not cached
+	gen uint64
+}
+
+type cacheEntry struct {
+	key     string
+	resp    response
+	expires time.Time
+}
+
+// cacheCall is a call being executed, waited for by calls with the same key
+type cacheCall struct {
+	// done is closed when the call finishes, resp is nil if the call didn't
+	// produce a response which can be shared
+	done chan struct{}
+	resp *response
+	gen  uint64
+}
+
+func newMethodCache(config CacheConfig) *methodCache {
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = DefaultCacheEntries
+	}
+	return &methodCache{
+		config:  config,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		calls:   map[string]*cacheCall{},
+	}
+}
+
+// key returns the cache key of a call. An error is returned when params
+// aren't valid JSON, such calls aren't cached.
+func (c *methodCache) key(ctx context.Context, params []param) (string, error) {
+	vals := make([]interface{}, len(params))
+	for i, p := range params {
+		if err := decodeValue(p.data, &vals[i], UseNumber); err != nil {
+			return "", err
+		}
+	}
+	b, err := json.Marshal(vals)
+	if err != nil {
+		return "", err
+	}
+
+	if c.config.Principal == nil {
+		return string(b), nil
+	}
+	return c.config.Principal(ctx) + "\x00" + string(b), nil
+}
+
+// begin returns the cached response for a key, or the call to wait for.
+// owner is true if the caller should execute the call and then call finish.
+func (c *methodCache) begin(key string) (cached *response, call *cacheCall, owner bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if e.expires.IsZero() || time.Now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			resp := e.resp
+			return &resp, nil, false
+		}
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+
+	if call, ok := c.calls[key]; ok {
+		return nil, call, false
+	}
+
+	call = &cacheCall{done: make(chan struct{}), gen: c.gen}
+	c.calls[key] = call
+	return nil, call, true
+}
+
+// finish shares the call response with waiting calls, and caches it when
+// it's a success. A nil response makes waiting calls try again.
+func (c *methodCache) finish(key string, call *cacheCall, resp *response) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	call.resp = resp
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	close(call.done)
+
+	if resp == nil || resp.Error != nil || call.gen != c.gen {
+		return
+	}
+
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+	}
+	e := &cacheEntry{key: key, resp: *resp}
+	if c.config.TTL > 0 {
+		e.expires = time.Now().Add(c.config.TTL)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+
+	for c.lru.Len() > c.config.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// clear drops all cached responses
+func (c *methodCache) clear() {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.calls = map[string]*cacheCall{}
+	c.gen++
+}
+
+// cacheFor returns the response cache of a method, if it has one. The
+// WithMethodCache server option takes precedence over MethodCache.
+func (s *RPCServer) cacheFor(method string, h rpcHandler) *methodCache {
+	if c, ok := s.caches[method]; ok {
+		return c
+	}
+	return h.cache
+}
+
+// InvalidateCache drops cached responses of a method (full name, e.g.
+// "Namespace.Method"). Calls running while it's called don't cache their
+// responses.
+func (s *RPCServer) InvalidateCache(method string) {
+	s.invalidateCaches(func(name string) bool {
+		return name == method
+	})
+}
+
+// InvalidateCachePrefix is like InvalidateCache, for all methods with names
+// starting with the prefix, e.g. "Namespace." for all methods of a namespace
+func (s *RPCServer) InvalidateCachePrefix(prefix string) {
+	s.invalidateCaches(func(name string) bool {
+		return strings.HasPrefix(name, prefix)
+	})
+}
+
+func (s *RPCServer) invalidateCaches(match func(name string) bool) {
+	var caches []*methodCache
+	for name, c := range s.caches {
+		if match(name) {
+			caches = append(caches, c)
+		}
+	}
+
+	s.methodsLk.RLock()
+	for name, h := range s.methods {
+		if h.cache != nil && match(name) {
+			caches = append(caches, h.cache)
+		}
+	}
+	s.methodsLk.RUnlock()
+
+	for _, c := range caches {
+		c.clear()
+	}
+}
@@ -0,0 +1,108 @@
+package jsonrpc
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/xerrors"
+)
+
+// Messages larger than the chunk size are sent as a series of binary
+// websocket messages, each starting with a header holding the message id and
+// flags, so that other messages can be written between the chunks. Chunks are
+// only sent to peers which announced support with chunkedHeader when
+// connecting.
+const chunkedHeader = "X-Jsonrpc-Chunked"
+
+// DEFAULT_CHUNK_SIZE is the default size of chunks large websocket messages
+// are split into. Configured by WithChunkSize.
+const DEFAULT_CHUNK_SIZE = 64 << 10 // 64 KiB
+
+const (
+	chunkHeaderSize = 9 // message id (uint64, big endian), flags
+
+	chunkFinal = 1 << 0
+)
+
+// maxPartialMessages limits how many chunked messages can be reassembled at
+// the same time on a connection
+const maxPartialMessages = 64
+
+// partialBytesFactor limits the bytes buffered for all chunked messages being
+// reassembled on a connection, as a multiple of the message size limit, so
+// that large messages of concurrent calls can interleave
+const partialBytesFactor = 8
+
+// chunkedMessage is a large outgoing message, written a chunk at a time
+type chunkedMessage struct {
+	id   uint64
+	data []byte
+}
+
+// next returns the next chunk to write, done is true for the last one
+func (m *chunkedMessage) next(size int) (chunk []byte, done bool) {
+	n := len(m.data)
+	if n > size {
+		n = size
+	}
+	done = n == len(m.data)
+
+	chunk = make([]byte, chunkHeaderSize+n)
+	binary.BigEndian.PutUint64(chunk, m.id)
+	if done {
+		chunk[8] = chunkFinal
+	}
+	copy(chunk[chunkHeaderSize:], m.data[:n])
+
+	m.data = m.data[n:]
+	return chunk, done
+}
+
+// chunkAssembler reassembles chunked messages on the reading side. max limits
+// the size of each message, maxTotal the bytes buffered for all messages in
+// progress.
+type chunkAssembler struct {
+	max      int64
+	maxTotal int64
+	msgs     map[uint64][]byte
+	total    int64
+}
+
+func newChunkAssembler(max int64) *chunkAssembler {
+	return &chunkAssembler{
+		max:      max,
+		maxTotal: max * partialBytesFactor,
+		msgs:     map[uint64][]byte{},
+	}
+}
+
+// add collects a chunk, the full message is returned with its final chunk
+func (a *chunkAssembler) add(chunk []byte) ([]byte, error) {
+	if len(chunk) < chunkHeaderSize {
+		return nil, xerrors.Errorf("chunk too short: %d bytes", len(chunk))
+	}
+	id := binary.BigEndian.Uint64(chunk)
+	data := chunk[chunkHeaderSize:]
+
+	msg, ok := a.msgs[id]
+	if !ok && len(a.msgs) >= maxPartialMessages {
+		return nil, xerrors.Errorf("more than %d chunked messages in progress", maxPartialMessages)
+	}
+
+	msg = append(msg, data...)
+	if a.max > 0 && int64(len(msg)) > a.max {
+		return nil, xerrors.Errorf("chunked message exceeds %d bytes", a.max)
+	}
+	a.total += int64(len(data))
+	if a.maxTotal > 0 && a.total > a.maxTotal {
+		return nil, xerrors.Errorf("chunked messages in progress exceed %d bytes", a.maxTotal)
+	}
+
+	if chunk[8]&chunkFinal == 0 {
+		a.msgs[id] = msg
+		return nil, nil
+	}
+
+	delete(a.msgs, id)
+	a.total -= int64(len(msg))
+	return msg, nil
+}
@@ -4,20 +4,20 @@ import (
 	"bytes"
 	"container/list"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"reflect"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	logging "github.com/ipfs/go-log/v2"
 	"go.opencensus.io/trace"
-	"go.opencensus.io/trace/propagation"
 	"golang.org/x/xerrors"
 )
 
@@ -60,15 +60,16 @@ func (e *ErrClient) Error() string {
 }
 
 // Unwrap unwraps the actual error
-func (e *ErrClient) Unwrap(err error) error {
+func (e *ErrClient) Unwrap() error {
 	return e.err
 }
 
 type clientResponse struct {
-	Jsonrpc string          `json:"jsonrpc"`
-	Result  json.RawMessage `json:"result"`
-	ID      int64           `json:"id"`
-	Error   *respError      `json:"error,omitempty"`
+	Jsonrpc string            `json:"jsonrpc"`
+	Result  json.RawMessage   `json:"result"`
+	ID      int64             `json:"id"`
+	Error   *respError        `json:"error,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
 }
 
 type makeChanSink func() (context.Context, func([]byte, bool))
@@ -79,6 +80,8 @@ type clientRequest struct {
 
 	// retCh provides a context and sink for handling incoming channel messages
 	retCh makeChanSink
+
+	offline OfflinePolicy
 }
 
 // ClientCloser is used to close Client from further use
@@ -94,8 +97,12 @@ func NewClient(ctx context.Context, addr string, namespace string, handler inter
 }
 
 type client struct {
-	namespace     string
-	paramEncoders map[reflect.Type]ParamEncoder
+	namespace      string
+	paramEncoders  map[reflect.Type]ParamEncoder
+	resultDecoders map[reflect.Type]ResultDecoder
+	decodeFlags    DecodeFlags
+	retryPolicy    *RetryPolicy
+	offlinePolicy  OfflinePolicy
 
 	doRequest func(context.Context, clientRequest) (clientResponse, error)
 	exiting   <-chan struct{}
@@ -105,31 +112,80 @@ type client struct {
 // NewMergeClient is like NewClient, but allows to specify multiple structs
 // to be filled in the same namespace, using one connection
 func NewMergeClient(ctx context.Context, addr string, namespace string, outs []interface{}, requestHeader http.Header, opts ...Option) (ClientCloser, error) {
+	return NewMultiClient(ctx, []string{addr}, namespace, outs, requestHeader, opts...)
+}
+
+// NewMultiClient is like NewMergeClient, but accepts multiple endpoints of
+// the same service (all ws(s) or all http(s)). Endpoints are picked according
+// to the BalancePolicy set with WithBalancePolicy; endpoints which fail are
+// avoided for a backoff period. Websocket clients keep a single connection and
+// move to another endpoint when it fails, HTTP clients spread calls across
+// healthy endpoints. More endpoints can be provided with WithResolver.
+func NewMultiClient(ctx context.Context, addrs []string, namespace string, outs []interface{}, requestHeader http.Header, opts ...Option) (ClientCloser, error) {
 	config := defaultConfig()
 	for _, o := range opts {
 		o(&config)
 	}
 
-	u, err := url.Parse(addr)
+	c, closer, err := newClient(ctx, addrs, namespace, requestHeader, config)
 	if err != nil {
-		return nil, xerrors.Errorf("parsing address: %w", err)
+		return nil, err
 	}
 
-	switch u.Scheme {
-	case "ws", "wss":
-		return websocketClient(ctx, addr, namespace, outs, requestHeader, config)
-	case "http", "https":
-		return httpClient(ctx, addr, namespace, outs, requestHeader, config)
-	default:
-		return nil, xerrors.Errorf("unknown url scheme '%s'", u.Scheme)
+	if err := c.provide(outs); err != nil {
+		closer()
+		return nil, err
+	}
+	return closer, nil
+}
+
+// newClient connects to the endpoints, the returned client makes calls with
+// funcs from makeRpcFunc
+func newClient(ctx context.Context, addrs []string, namespace string, requestHeader http.Header, config Config) (*client, ClientCloser, error) {
+	pool, err := newEndpointPool(ctx, addrs, config)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	if pool.websocket || config.httpStream {
+		return websocketClient(ctx, pool, namespace, requestHeader, config)
+	}
+	return httpClient(ctx, pool, namespace, requestHeader, config)
+}
+
+// errHTTPStatus is returned when an endpoint responds with a status which
+// doesn't carry a JSON-RPC response, e.g. from a proxy in front of it
+type errHTTPStatus struct {
+	code   int
+	status string
 }
 
-func httpClient(ctx context.Context, addr string, namespace string, outs []interface{}, requestHeader http.Header, config Config) (ClientCloser, error) {
+func (e *errHTTPStatus) Error() string {
+	return fmt.Sprintf("unexpected http status: %s", e.status)
+}
+
+// releaseBody calls release once the body is closed
+type releaseBody struct {
+	io.ReadCloser
+
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+func httpClient(ctx context.Context, pool *endpointPool, namespace string, requestHeader http.Header, config Config) (*client, ClientCloser, error) {
 	c := client{
-		namespace:     namespace,
-		paramEncoders: config.paramEncoders,
+		namespace:      namespace,
+		paramEncoders:  config.paramEncoders,
+		resultDecoders: config.resultDecoders,
+		decodeFlags:    config.decodeFlags,
+		retryPolicy:    config.retryPolicy,
+		offlinePolicy:  config.offlinePolicy,
 	}
 
 	stop := make(chan struct{})
@@ -139,11 +195,17 @@ func httpClient(ctx context.Context, addr string, namespace string, outs []inter
 		requestHeader = http.Header{}
 	}
 
-	c.doRequest = func(ctx context.Context, cr clientRequest) (clientResponse, error) {
-		b, err := json.Marshal(&cr.req)
-		if err != nil {
-			return clientResponse{}, xerrors.Errorf("mershaling requset: %w", err)
-		}
+	var pollChannel func(addr string, result json.RawMessage, cr clientRequest, release func()) error
+
+	// doHTTPRequest calls release when done with the endpoint, which is only
+	// once channels returned by the call are closed
+	doHTTPRequest := func(ctx context.Context, addr string, b []byte, cr clientRequest, release func()) (clientResponse, error) {
+		held := false
+		defer func() {
+			if !held {
+				release()
+			}
+		}()
 
 		hreq, err := http.NewRequest("POST", addr, bytes.NewReader(b))
 		if err != nil {
@@ -157,16 +219,41 @@ func httpClient(ctx context.Context, addr string, namespace string, outs []inter
 		}
 
 		hreq.Header.Set("Content-Type", "application/json")
+		if cr.retCh != nil {
+			if config.longPoll {
+				hreq.Header.Set(longPollHeader, "1")
+			} else {
+				hreq.Header.Set("Accept", eventStreamType)
+			}
+		}
+		if tp, ok := cr.req.Meta[metaTraceparent]; ok {
+			hreq.Header.Set(metaTraceparent, tp)
+			if ts, ok := cr.req.Meta[metaTracestate]; ok {
+				hreq.Header.Set(metaTracestate, ts)
+			}
+		}
 
-		httpResp, err := _defaultHTTPClient.Do(hreq)
+		httpResp, err := config.httpClient.Do(hreq)
 		if err != nil {
 			return clientResponse{}, err
 		}
+
+		switch httpResp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			httpResp.Body.Close()
+			return clientResponse{}, &errHTTPStatus{code: httpResp.StatusCode, status: httpResp.Status}
+		}
+
+		if cr.retCh != nil && strings.HasPrefix(httpResp.Header.Get("Content-Type"), eventStreamType) {
+			// the stream is read until the channel is closed
+			held = true
+			return readEventStream(&releaseBody{ReadCloser: httpResp.Body, release: release}, cr)
+		}
 		defer httpResp.Body.Close()
 
 		var resp clientResponse
 
-		if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		if err := decodeMessage(httpResp.Body, &resp, config.decodeFlags); err != nil {
 			return clientResponse{}, xerrors.Errorf("unmarshaling response: %w", err)
 		}
 
@@ -174,50 +261,256 @@ func httpClient(ctx context.Context, addr string, namespace string, outs []inter
 			return clientResponse{}, xerrors.New("request and response id didn't match")
 		}
 
+		if cr.retCh != nil && config.longPoll && resp.Error == nil && resp.Result != nil {
+			if err := pollChannel(addr, resp.Result, cr, release); err != nil {
+				return clientResponse{}, err
+			}
+			held = true
+		}
+
 		return resp, nil
 	}
 
-	if err := c.provide(outs); err != nil {
-		return nil, err
+	// callBuiltin calls an xrpc method on a specific endpoint
+	callBuiltin := func(ctx context.Context, addr string, method string, params []param, out interface{}) error {
+		id := atomic.AddInt64(&c.idCtr, 1)
+		cr := clientRequest{
+			req: request{
+				Jsonrpc: "2.0",
+				ID:      &id,
+				Method:  method,
+				Params:  params,
+			},
+		}
+
+		b, err := json.Marshal(&cr.req)
+		if err != nil {
+			return xerrors.Errorf("marshaling request: %w", err)
+		}
+		resp, err := doHTTPRequest(ctx, addr, b, cr, func() {})
+		if err != nil {
+			return err
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, out)
+	}
+
+	// pollChannel polls a long-polled channel on the endpoint which returned
+	// it, until the channel is closed or the call context is done. release is
+	// called when polling stops.
+	pollChannel = func(addr string, result json.RawMessage, cr clientRequest, release func()) error {
+		var chid uint64
+		if err := json.Unmarshal(result, &chid); err != nil {
+			return xerrors.Errorf("unmarshaling channel id: %w", err)
+		}
+		params := []param{{v: reflect.ValueOf(chid)}}
+
+		ctx, sink := cr.retCh()
+		go func() {
+			defer release()
+			defer sink(nil, false)
+
+			for {
+				var res pollResult
+				err := callBuiltin(ctx, addr, pollChannelMethod, params, &res)
+				if ctx.Err() != nil {
+					// tell the server to close the channel
+					cctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					if err := callBuiltin(cctx, addr, closeChannelMethod, params, nil); err != nil {
+						log.Warnw("closing long-polled channel", "error", err)
+					}
+					cancel()
+					return
+				}
+				if err != nil {
+					log.Errorw("polling channel failed", "method", cr.req.Method, "error", err)
+					return
+				}
+
+				for _, v := range res.Values {
+					sink(v, true)
+				}
+				if res.Closed {
+					if res.Error != "" {
+						log.Errorw("channel closed by the server", "method", cr.req.Method, "error", res.Error)
+					}
+					return
+				}
+			}
+		}()
+
+		return nil
+	}
+
+	c.doRequest = func(ctx context.Context, cr clientRequest) (clientResponse, error) {
+		b, err := json.Marshal(&cr.req)
+		if err != nil {
+			return clientResponse{}, xerrors.Errorf("mershaling requset: %w", err)
+		}
+
+		tried := map[*endpoint]bool{}
+		for {
+			ep := pool.pick(ctx, tried)
+			// open channels count as in-flight calls on the endpoint
+			resp, err := doHTTPRequest(ctx, ep.addr, b, cr, func() { pool.release(ep) })
+			if err == nil {
+				pool.markOK(ep)
+				return resp, nil
+			}
+
+			var statusErr *errHTTPStatus
+			isStatusErr := xerrors.As(err, &statusErr)
+			if !isDialError(err) && !isStatusErr {
+				return clientResponse{}, err
+			}
+			pool.markFailed(ep)
+
+			// only fail over when the request surely wasn't processed
+			tried[ep] = true
+			refused := isDialError(err) || statusErr.code == http.StatusServiceUnavailable
+			if !refused || len(tried) >= pool.size() {
+				return clientResponse{}, err
+			}
+			log.Warnw("endpoint unavailable, trying another one", "addr", ep.addr, "error", err)
+		}
 	}
 
-	return func() {
+	return &c, func() {
 		close(stop)
 	}, nil
 }
 
-func websocketClient(ctx context.Context, addr string, namespace string, outs []interface{}, requestHeader http.Header, config Config) (ClientCloser, error) {
-	connFactory := func() (*websocket.Conn, error) {
-		conn, _, err := websocket.DefaultDialer.Dial(addr, requestHeader)
-		return conn, err
+func websocketClient(ctx context.Context, pool *endpointPool, namespace string, requestHeader http.Header, config Config) (*client, ClientCloser, error) {
+	// tell the server we accept chunked messages
+	header := requestHeader.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set(chunkedHeader, "1")
+
+	// endpoint of the current connection; when the factory gets called again
+	// the connection was lost, so the endpoint is marked as failed
+	var current *endpoint
+	// whether the server of the current connection accepts chunked messages
+	var serverChunked bool
+	pick := func() *endpoint {
+		if current != nil {
+			pool.release(current)
+			pool.markFailed(current)
+			current = nil
+		}
+		return pool.pick(ctx, nil)
 	}
 
-	if config.proxyConnFactory != nil {
-		// used in tests
-		connFactory = config.proxyConnFactory(connFactory)
+	var connFactory func() (msgConn, error)
+	if pool.websocket {
+		wsFactory := func() (*websocket.Conn, error) {
+			ep := pick()
+			conn, resp, err := websocket.DefaultDialer.Dial(ep.addr, header)
+			if err != nil {
+				pool.release(ep)
+				pool.markFailed(ep)
+				return nil, err
+			}
+
+			pool.markOK(ep)
+			current = ep
+			serverChunked = resp.Header.Get(chunkedHeader) != ""
+			return conn, nil
+		}
+
+		if config.proxyConnFactory != nil {
+			// used in tests
+			wsFactory = config.proxyConnFactory(wsFactory)
+		}
+
+		connFactory = func() (msgConn, error) {
+			conn, err := wsFactory()
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+	} else {
+		// HTTP/2 streams, see WithHTTPStream
+		connFactory = func() (msgConn, error) {
+			ep := pick()
+			conn, err := dialStream(ctx, config.httpClient, ep.addr, header)
+			if err != nil {
+				pool.release(ep)
+				pool.markFailed(ep)
+				return nil, err
+			}
+
+			pool.markOK(ep)
+			current = ep
+			return conn, nil
+		}
 	}
 
-	conn, err := connFactory()
+	var conn msgConn
+	var err error
+	for i := 0; i < pool.size(); i++ {
+		conn, err = connFactory()
+		if err == nil {
+			break
+		}
+		log.Warnw("websocket connection failed", "error", err)
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	status := config.connStatus
+	if status == nil {
+		status = &ConnStatus{}
 	}
+	status.set(StateConnected, nil)
 
 	if config.noReconnect {
 		connFactory = nil
 	}
 
 	c := client{
-		namespace:     namespace,
-		paramEncoders: config.paramEncoders,
+		namespace:      namespace,
+		paramEncoders:  config.paramEncoders,
+		resultDecoders: config.resultDecoders,
+		decodeFlags:    config.decodeFlags,
+		retryPolicy:    config.retryPolicy,
+		offlinePolicy:  config.offlinePolicy,
 	}
 
 	requests := make(chan clientRequest)
 
+	queue := newOfflineQueue(config.offlineQueueSize)
+
 	c.doRequest = func(ctx context.Context, cr clientRequest) (clientResponse, error) {
-		select {
-		case requests <- cr:
-		case <-c.exiting:
-			return clientResponse{}, fmt.Errorf("websocket routine exiting")
+		queued := false
+		switch state := status.State(); {
+		case state == StateConnected && (cr.offline < OfflineQueue || queue.len() == 0):
+		case state == StateClosed:
+		case cr.offline == OfflineFailFast:
+			return clientResponse{}, ErrDisconnected
+		case cr.offline == OfflineQueue, cr.offline == OfflineReplay:
+			// queued calls are sent by the queue once connected, and keep
+			// their order with calls queued before
+			if err := queue.push(cr); err != nil {
+				return clientResponse{}, err
+			}
+			queued = true
+		}
+
+		if !queued {
+			select {
+			case requests <- cr:
+			case <-c.exiting:
+				return clientResponse{}, fmt.Errorf("websocket routine exiting")
+			}
 		}
 
 		var ctxDone <-chan struct{}
@@ -236,6 +529,11 @@ func websocketClient(ctx context.Context, addr string, namespace string, outs []
 			case <-ctxDone: // send cancel request
 				ctxDone = nil
 
+				if cr.req.ID != nil && queue.remove(*cr.req.ID) {
+					// never sent, nothing to cancel
+					return clientResponse{}, ctx.Err()
+				}
+
 				cancelReq := clientRequest{
 					req: request{
 						Jsonrpc: "2.0",
@@ -271,16 +569,23 @@ func websocketClient(ctx context.Context, addr string, namespace string, outs []
 		requests:         requests,
 		stop:             stop,
 		exiting:          exiting,
-	}
-	go wconn.handleWsConn(ctx)
 
-	if err := c.provide(outs); err != nil {
-		return nil, err
+		status:               status,
+		maxReconnectAttempts: config.maxReconnectAttempts,
+		offline:              queue,
+
+		nativePing:  config.nativePing && pool.websocket,
+		idleTimeout: 3 * config.pingInterval,
+
+		chunkSize:      config.chunkSize,
+		maxMessageSize: config.maxMessageSize,
+		peerChunked:    func() bool { return serverChunked },
 	}
+	go wconn.handleWsConn(ctx)
+	go queue.run(status, requests, exiting)
 
-	return func() {
+	return &c, func() {
 		close(stop)
-		wconn.isStoped = true
 		<-exiting
 	}, nil
 }
@@ -311,7 +616,9 @@ func (c *client) provide(outs []interface{}) error {
 	return nil
 }
 
-func (c *client) makeOutChan(ctx context.Context, ftyp reflect.Type, valOut int) (func() reflect.Value, makeChanSink) {
+// makeOutChan creates the channel returned from a call, with unwrapEvent set
+// values are Events and only their Value is passed to the channel
+func (c *client) makeOutChan(ctx context.Context, ftyp reflect.Type, valOut int, unwrapEvent bool) (func() reflect.Value, makeChanSink) {
 	retVal := reflect.Zero(ftyp.Out(valOut))
 
 	chCtor := func() (context.Context, func([]byte, bool)) {
@@ -382,11 +689,22 @@ func (c *client) makeOutChan(ctx context.Context, ftyp reflect.Type, valOut int)
 				return
 			}
 
-			val := reflect.New(ftyp.Out(valOut).Elem())
-			if err := json.Unmarshal(result, val.Interface()); err != nil {
+			if unwrapEvent {
+				var ev Event
+				if err := json.Unmarshal(result, &ev); err != nil {
+					log.Errorf("error unmarshaling event: %s", err)
+					return
+				}
+				result = ev.Value
+			}
+
+			v, err := c.decodeResult(ctx, result, ftyp.Out(valOut).Elem())
+			if err != nil {
 				log.Errorf("error unmarshaling chan response: %s", err)
 				return
 			}
+			val := reflect.New(ftyp.Out(valOut).Elem())
+			val.Elem().Set(v)
 
 			if ctx.Err() != nil {
 				log.Errorf("got rpc message with cancelled context: %s", ctx.Err())
@@ -403,12 +721,14 @@ func (c *client) makeOutChan(ctx context.Context, ftyp reflect.Type, valOut int)
 	return func() reflect.Value { return retVal }, chCtor
 }
 
-func (c *client) sendRequest(ctx context.Context, req request, chCtor makeChanSink) (clientResponse, error) {
+func (c *client) sendRequest(ctx context.Context, req request, chCtor makeChanSink, offline OfflinePolicy) (clientResponse, error) {
 	creq := clientRequest{
 		req:   req,
 		ready: make(chan clientResponse, 1),
 
 		retCh: chCtor,
+
+		offline: offline,
 	}
 
 	return c.doRequest(ctx, creq)
@@ -427,7 +747,14 @@ type rpcFunc struct {
 	hasCtx               int
 	returnValueIsChannel bool
 
-	retry bool
+	retryPolicy *RetryPolicy
+	// retryRefusedOnly limits retries to calls which surely weren't
+	// processed by the server, for methods not tagged with `retry`
+	retryRefusedOnly bool
+	offline          OfflinePolicy
+
+	// subscribe is set for pub/sub subscriptions, see the `subscribe` tag
+	subscribe bool
 }
 
 func (fn *rpcFunc) processResponse(resp clientResponse, rval reflect.Value) []reflect.Value {
@@ -461,6 +788,23 @@ func (fn *rpcFunc) processError(err error) []reflect.Value {
 }
 
 func (fn *rpcFunc) handleRpcCall(args []reflect.Value) (results []reflect.Value) {
+	ctx := context.Background()
+	if fn.hasCtx == 1 {
+		ctx = args[0].Interface().(context.Context)
+	}
+	ctx, span := trace.StartSpan(ctx, "api.call", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		if fn.errOut != -1 {
+			switch err := results[fn.errOut].Interface().(type) {
+			case *respError:
+				setSpanError(span, err.Code, err.Message)
+			case error:
+				setSpanError(span, 0, err.Error())
+			}
+		}
+		span.End()
+	}()
+
 	id := atomic.AddInt64(&fn.client.idCtr, 1)
 	params := make([]param, len(args)-fn.hasCtx)
 	for i, arg := range args[fn.hasCtx:] {
@@ -479,25 +823,24 @@ func (fn *rpcFunc) handleRpcCall(args []reflect.Value) (results []reflect.Value)
 		}
 	}
 
-	var ctx context.Context
-	var span *trace.Span
-	if fn.hasCtx == 1 {
-		ctx = args[0].Interface().(context.Context)
-		ctx, span = trace.StartSpan(ctx, "api.call")
-		defer span.End()
-	}
-
 	retVal := func() reflect.Value { return reflect.Value{} }
 
 	// if the function returns a channel, we need to provide a sink for the
 	// messages
 	var chCtor makeChanSink
 	if fn.returnValueIsChannel {
-		retVal, chCtor = fn.client.makeOutChan(ctx, fn.ftyp, fn.valOut)
+		unwrap := fn.subscribe && fn.ftyp.Out(fn.valOut).Elem() != eventType
+		retVal, chCtor = fn.client.makeOutChan(ctx, fn.ftyp, fn.valOut, unwrap)
 	}
 
 	method := ""
-	if fn.client.namespace == "" {
+	if fn.subscribe {
+		method = subscribeMethod
+		if len(params) == 1 {
+			// no filter
+			params = append(params, param{v: reflect.ValueOf(EventFilter(nil))})
+		}
+	} else if fn.client.namespace == "" {
 		method = fn.name
 	} else {
 		method = fn.client.namespace + "." + fn.name
@@ -507,29 +850,37 @@ func (fn *rpcFunc) handleRpcCall(args []reflect.Value) (results []reflect.Value)
 		ID:      &id,
 		Method:  method,
 		Params:  params,
+		Meta:    outgoingMeta(ctx),
 	}
 
-	if span != nil {
-		span.AddAttributes(trace.StringAttribute("method", req.Method))
+	span.AddAttributes(trace.StringAttribute("method", req.Method))
+	injectSpanContext(req.Meta, span.SpanContext())
 
-		eSC := base64.StdEncoding.EncodeToString(
-			propagation.Binary(span.SpanContext()))
-		req.Meta = map[string]string{
-			"SpanContext": eSC,
+	var retryDeadline time.Time
+	if fn.retryPolicy != nil {
+		req.Meta[metaIdempotencyKey] = newIdempotencyKey()
+		if fn.retryPolicy.Budget > 0 {
+			retryDeadline = time.Now().Add(fn.retryPolicy.Budget)
 		}
 	}
 
-	b := backoff{
-		maxDelay: methodMaxRetryDelay,
-		minDelay: methodMinRetryDelay,
-	}
-
 	var resp clientResponse
 	var err error
-	// keep retrying if got a forced closed websocket conn and calling method
-	// has retry annotation
+	// keep retrying while the retry policy allows
 	for attempt := 0; true; attempt++ {
-		resp, err = fn.client.sendRequest(ctx, req, chCtor)
+		// the server gets the time left for this attempt
+		if deadline, ok := ctx.Deadline(); ok {
+			req.Meta[metaTimeout] = time.Until(deadline).String()
+		}
+
+		resp, err = fn.client.sendRequest(ctx, req, chCtor, fn.offline)
+		if fn.retryPolicy != nil && (!fn.retryRefusedOnly || refused(resp, err)) {
+			if delay, ok := fn.retryPolicy.nextDelay(ctx, attempt, retryDeadline, resp, err); ok {
+				log.Debugw("retrying call", "method", req.Method, "attempt", attempt+1, "delay", delay)
+				sleepCtx(ctx, delay)
+				continue
+			}
+		}
 		if err != nil {
 			return fn.processError(fmt.Errorf("sendRequest failed: %w", err))
 		}
@@ -539,26 +890,24 @@ func (fn *rpcFunc) handleRpcCall(args []reflect.Value) (results []reflect.Value)
 		}
 
 		if fn.valOut != -1 && !fn.returnValueIsChannel {
-			val := reflect.New(fn.ftyp.Out(fn.valOut))
+			val := reflect.New(fn.ftyp.Out(fn.valOut)).Elem()
 
 			if resp.Result != nil {
 				//log.Debugw("rpc result", "type", fn.ftyp.Out(fn.valOut))
-				if err := json.Unmarshal(resp.Result, val.Interface()); err != nil {
+				v, err := fn.client.decodeResult(ctx, resp.Result, fn.ftyp.Out(fn.valOut))
+				if err != nil {
 					log.Warnw("unmarshaling failed", "message", string(resp.Result))
 					return fn.processError(xerrors.Errorf("unmarshaling result: %w", err))
 				}
+				val.Set(v)
 			}
 
-			retVal = func() reflect.Value { return val.Elem() }
-		}
-		retry := resp.Error != nil && resp.Error.Code == 2 && fn.retry
-		if !retry {
-			break
+			retVal = func() reflect.Value { return val }
 		}
-
-		time.Sleep(b.next(attempt))
+		break
 	}
 
+	deliverResponseMeta(ctx, resp.Meta)
 	return fn.processResponse(resp, retVal())
 }
 
@@ -577,7 +926,26 @@ func (c *client) makeRpcFunc(f reflect.StructField) (reflect.Value, error) {
 		client: c,
 		ftyp:   ftyp,
 		name:   fname,
-		retry:  f.Tag.Get("retry") == "true",
+	}
+	switch f.Tag.Get("retry") {
+	case "true":
+		fun.retryPolicy = c.retryPolicy
+		if fun.retryPolicy == nil {
+			fun.retryPolicy = legacyRetryPolicy
+		}
+	case "false":
+	default:
+		fun.retryPolicy = c.retryPolicy
+		fun.retryRefusedOnly = true
+	}
+
+	fun.offline = c.offlinePolicy
+	if tag, ok := f.Tag.Lookup("offline"); ok {
+		p, err := parseOfflinePolicy(tag)
+		if err != nil {
+			return reflect.Value{}, xerrors.Errorf("method %s: %w", f.Name, err)
+		}
+		fun.offline = p
 	}
 	fun.valOut, fun.errOut, fun.nout = processFuncOut(ftyp)
 
@@ -586,5 +954,28 @@ func (c *client) makeRpcFunc(f reflect.StructField) (reflect.Value, error) {
 	}
 	fun.returnValueIsChannel = fun.valOut != -1 && ftyp.Out(fun.valOut).Kind() == reflect.Chan
 
+	if f.Tag.Get("subscribe") == "true" {
+		if err := checkSubscribeFunc(ftyp, fun); err != nil {
+			return reflect.Value{}, xerrors.Errorf("method %s: %w", f.Name, err)
+		}
+		fun.subscribe = true
+	}
+
 	return reflect.MakeFunc(ftyp, fun.handleRpcCall), nil
 }
+
+// checkSubscribeFunc makes sure a func tagged with `subscribe:"true"` looks
+// like func(ctx, topic string[, filter EventFilter]) (<-chan T, error)
+func checkSubscribeFunc(ftyp reflect.Type, fun *rpcFunc) error {
+	ins := ftyp.NumIn() - fun.hasCtx
+	if fun.hasCtx == 0 || ins < 1 || ins > 2 || ftyp.In(1).Kind() != reflect.String {
+		return xerrors.New("subscribe func must take a context, a topic and an optional EventFilter")
+	}
+	if ins == 2 && ftyp.In(2) != reflect.TypeOf(EventFilter(nil)) {
+		return xerrors.New("subscribe func filter must be an EventFilter")
+	}
+	if !fun.returnValueIsChannel || fun.errOut == -1 {
+		return xerrors.New("subscribe func must return a channel and an error")
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package jsonrpc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrDisconnected is returned by fail-fast websocket clients for calls made
+// while the connection is down
+var ErrDisconnected = xerrors.New("websocket connection is not established")
+
+// ConnState is the state of a websocket client connection
+type ConnState int
+
+const (
+	StateConnecting ConnState = iota
+	StateConnected
+	StateReconnecting
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnStateChange describes a connection state transition. Reason is set when
+// the change was caused by an error.
+type ConnStateChange struct {
+	State  ConnState
+	Reason error
+}
+
+// ConnStatus tracks the connection state of a websocket client. Pass it to a
+// client with WithConnStatus.
+type ConnStatus struct {
+	lk        sync.Mutex
+	state     ConnState
+	rtt       time.Duration
+	subs      []chan ConnStateChange
+	callbacks []func(ConnStateChange)
+}
+
+// State returns the current connection state
+func (s *ConnStatus) State() ConnState {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	return s.state
+}
+
+// RTT returns the round-trip time measured by the last keepalive ping, zero
+// if none was measured yet
+func (s *ConnStatus) RTT() time.Duration {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	return s.rtt
+}
+
+func (s *ConnStatus) setRTT(rtt time.Duration) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.rtt = rtt
+}
+
+// Subscribe returns a channel receiving state changes. Changes are dropped
+// when the channel buffer is full, State can be used to catch up.
+func (s *ConnStatus) Subscribe(buf int) <-chan ConnStateChange {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	ch := make(chan ConnStateChange, buf)
+	if s.state == StateClosed {
+		close(ch)
+		return ch
+	}
+	s.subs = append(s.subs, ch)
+	return ch
+}
+
+// OnChange registers a callback called on each state change. Callbacks are
+// called synchronously from the connection goroutine and must not block.
+func (s *ConnStatus) OnChange(cb func(ConnStateChange)) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.callbacks = append(s.callbacks, cb)
+}
+
+func (s *ConnStatus) set(state ConnState, reason error) {
+	s.lk.Lock()
+	if s.state == state {
+		s.lk.Unlock()
+		return
+	}
+	s.state = state
+
+	change := ConnStateChange{State: state, Reason: reason}
+	callbacks := s.callbacks
+	for _, ch := range s.subs {
+		select {
+		case ch <- change:
+		default:
+			log.Warnw("connection state subscriber is full, dropping change", "state", state)
+		}
+	}
+	if state == StateClosed {
+		for _, ch := range s.subs {
+			close(ch)
+		}
+		s.subs = nil
+	}
+	s.lk.Unlock()
+
+	for _, cb := range callbacks {
+		cb(change)
+	}
+}
+
+type wsConnKey struct{}
+
+// ConnRTT returns the keepalive round-trip time of the websocket connection a
+// call was received on. False is returned for calls which didn't come over a
+// websocket, or when no round-trip was measured yet.
+func ConnRTT(ctx context.Context) (time.Duration, bool) {
+	c, ok := ctx.Value(wsConnKey{}).(*wsConn)
+	if !ok {
+		return 0, false
+	}
+	rtt := time.Duration(atomic.LoadInt64(&c.rtt))
+	return rtt, rtt > 0
+}
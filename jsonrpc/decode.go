@@ -0,0 +1,147 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+
+	"golang.org/x/xerrors"
+)
+
+// DecodeFlags make decoding of params (on the server, see WithParamDecoding)
+// and results (on the client, see WithResultDecoding) stricter
+type DecodeFlags int
+
+const (
+	// DisallowUnknownFields rejects objects with fields the Go type doesn't
+	// have, see json.Decoder.DisallowUnknownFields
+	DisallowUnknownFields DecodeFlags = 1 << iota
+
+	// UseNumber decodes numbers into interface{} values as json.Number
+	// instead of float64, which can't hold all int64 values
+	UseNumber
+
+	// RejectTrailingData rejects HTTP bodies with data after the JSON-RPC
+	// message
+	RejectTrailingData
+
+	// StrictDecoding rejects anything which doesn't exactly match the types
+	StrictDecoding = DisallowUnknownFields | RejectTrailingData
+)
+
+var errTrailingData = xerrors.New("unexpected data after top-level value")
+
+// ResultEncoder converts method results before they are sent, the server
+// counterpart of ParamEncoder
+type ResultEncoder func(reflect.Value) (reflect.Value, error)
+
+// ResultDecoder decodes results of a type on the client, the client
+// counterpart of ParamDecoder
+type ResultDecoder func(ctx context.Context, json []byte) (reflect.Value, error)
+
+func newDecoder(r io.Reader, flags DecodeFlags) *json.Decoder {
+	dec := json.NewDecoder(r)
+	if flags&DisallowUnknownFields != 0 {
+		dec.DisallowUnknownFields()
+	}
+	if flags&UseNumber != 0 {
+		dec.UseNumber()
+	}
+	return dec
+}
+
+// decodeMessage decodes a JSON-RPC message from an HTTP body
+func decodeMessage(r io.Reader, v interface{}, flags DecodeFlags) error {
+	// unknown fields of the message itself are allowed for compatibility
+	dec := newDecoder(r, flags&^DisallowUnknownFields)
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if flags&RejectTrailingData != 0 {
+		if _, err := dec.Token(); err != io.EOF {
+			return errTrailingData
+		}
+	}
+	return nil
+}
+
+// decodeValue decodes a param or result value
+func decodeValue(data []byte, v interface{}, flags DecodeFlags) error {
+	return newDecoder(bytes.NewReader(data), flags).Decode(v)
+}
+
+// encodeResult applies a result encoder registered for the type, if any
+func encodeResult(encoders map[reflect.Type]ResultEncoder, typ reflect.Type, v reflect.Value) (reflect.Value, error) {
+	enc, found := encoders[typ]
+	if !found {
+		return v, nil
+	}
+	return enc(v)
+}
+
+// chanEncodeError takes the place of a channel value which failed to encode.
+// Marshaling it fails, so that the channel is closed with the error like when
+// a value can't be marshaled.
+type chanEncodeError struct {
+	err error
+}
+
+func (e chanEncodeError) MarshalJSON() ([]byte, error) {
+	return nil, xerrors.Errorf("encoding channel value: %w", e.err)
+}
+
+// encodeChanResults returns a channel with values of ch converted by the
+// encoder, values are forwarded until ch is closed, a value fails to encode,
+// or ctx is done
+func encodeChanResults(ctx context.Context, enc ResultEncoder, ch reflect.Value) reflect.Value {
+	out := make(chan interface{})
+
+	go func() {
+		defer close(out)
+
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+			{Dir: reflect.SelectRecv, Chan: ch},
+		}
+		for {
+			chosen, val, ok := reflect.Select(cases)
+			if chosen == 0 || !ok {
+				return
+			}
+
+			ev, err := enc(val)
+			if err != nil {
+				log.Errorf("encoding channel value: %s", err)
+				select {
+				case out <- chanEncodeError{err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+
+			select {
+			case out <- ev.Interface():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return reflect.ValueOf(out)
+}
+
+// decodeResult decodes a result value, with a result decoder registered for
+// the type if any
+func (c *client) decodeResult(ctx context.Context, data []byte, typ reflect.Type) (reflect.Value, error) {
+	if dec, found := c.resultDecoders[typ]; found {
+		return dec(ctx, data)
+	}
+
+	val := reflect.New(typ)
+	if err := decodeValue(data, val.Interface(), c.decodeFlags); err != nil {
+		return reflect.Value{}, err
+	}
+	return val.Elem(), nil
+}
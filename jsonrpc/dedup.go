@@ -0,0 +1,84 @@
+package jsonrpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// dedupCache remembers responses of calls carrying an idempotency key, so
+// that retried calls aren't executed twice
+type dedupCache struct {
+	lk      sync.Mutex
+	window  time.Duration
+	entries map[string]*dedupEntry
+	swept   time.Time
+
+	// principal scopes keys to who makes calls, when set
+	principal func(ctx context.Context) string
+}
+
+type dedupEntry struct {
+	// done is closed when the call finishes, resp is nil if the call didn't
+	// produce a response which can be replayed
+	done    chan struct{}
+	resp    *response
+	expires time.Time
+}
+
+func newDedupCache(window time.Duration, principal func(ctx context.Context) string) *dedupCache {
+	return &dedupCache{
+		window:    window,
+		entries:   map[string]*dedupEntry{},
+		principal: principal,
+	}
+}
+
+// key returns the key of a call to method carrying an idempotency key
+func (d *dedupCache) key(ctx context.Context, method, idempotencyKey string) string {
+	key := method + "/" + idempotencyKey
+	if d.principal == nil {
+		return key
+	}
+	return d.principal(ctx) + "\x00" + key
+}
+
+// begin returns the entry for a key, owner is true if the caller should
+// execute the call and then call finish
+func (d *dedupCache) begin(key string) (e *dedupEntry, owner bool) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.swept) > d.window {
+		d.swept = now
+		for k, e := range d.entries {
+			if !e.expires.IsZero() && now.After(e.expires) {
+				delete(d.entries, k)
+			}
+		}
+	}
+
+	if e, ok := d.entries[key]; ok && (e.expires.IsZero() || now.Before(e.expires)) {
+		return e, false
+	}
+
+	e = &dedupEntry{done: make(chan struct{})}
+	d.entries[key] = e
+	return e, true
+}
+
+// finish stores the call response, a nil response forgets the key, so a
+// retry will execute the call again
+func (d *dedupCache) finish(key string, e *dedupEntry, resp *response) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	e.resp = resp
+	if resp == nil {
+		delete(d.entries, key)
+	} else {
+		e.expires = time.Now().Add(d.window)
+	}
+	close(e.done)
+}
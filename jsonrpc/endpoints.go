@@ -0,0 +1,257 @@
+package jsonrpc
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Resolver returns the current list of endpoint addresses a client can use.
+// It is called when the client is created and then periodically, at most once
+// every resolveInterval, when picking endpoints.
+type Resolver func(ctx context.Context) ([]string, error)
+
+// BalancePolicy selects how clients with multiple endpoints pick one
+type BalancePolicy int
+
+const (
+	// RoundRobin cycles through healthy endpoints
+	RoundRobin BalancePolicy = iota
+	// LeastInflight picks the healthy endpoint with the fewest running calls,
+	// channels returned by calls count as running until they are closed. Only
+	// meaningful in HTTP mode, websocket clients use a single connection.
+	LeastInflight
+	// Priority picks the first healthy endpoint, in the order they were given
+	Priority
+)
+
+const resolveInterval = 30 * time.Second
+
+type endpoint struct {
+	addr string
+
+	inflight int
+	failures int
+	// unhealthy endpoints aren't picked until retryAt, unless all are unhealthy
+	retryAt time.Time
+}
+
+func (e *endpoint) healthy(now time.Time) bool {
+	return !now.Before(e.retryAt)
+}
+
+type endpointPool struct {
+	lk sync.Mutex
+
+	endpoints []*endpoint
+	policy    BalancePolicy
+	backoff   backoff
+
+	resolver   Resolver
+	resolvedAt time.Time
+
+	// websocket or http, all endpoints must use the same transport
+	websocket bool
+	rr        int
+}
+
+func newEndpointPool(ctx context.Context, addrs []string, config Config) (*endpointPool, error) {
+	p := &endpointPool{
+		policy:   config.balancePolicy,
+		backoff:  config.endpointBackoff,
+		resolver: config.resolver,
+	}
+
+	if p.resolver != nil {
+		resolved, err := p.resolver(ctx)
+		if err != nil {
+			return nil, xerrors.Errorf("resolving endpoints: %w", err)
+		}
+		addrs = append(append([]string{}, addrs...), resolved...)
+		p.resolvedAt = time.Now()
+	}
+
+	if len(addrs) == 0 {
+		return nil, xerrors.New("no endpoints given")
+	}
+
+	for i, addr := range addrs {
+		ws, err := isWebsocketAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			p.websocket = ws
+		} else if ws != p.websocket {
+			return nil, xerrors.Errorf("endpoint '%s': mixing websocket and http endpoints is not supported", addr)
+		}
+
+		p.endpoints = append(p.endpoints, &endpoint{addr: addr})
+	}
+
+	return p, nil
+}
+
+func isWebsocketAddr(addr string) (bool, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return false, xerrors.Errorf("parsing address: %w", err)
+	}
+
+	switch u.Scheme {
+	case "ws", "wss":
+		return true, nil
+	case "http", "https":
+		return false, nil
+	default:
+		return false, xerrors.Errorf("unknown url scheme '%s'", u.Scheme)
+	}
+}
+
+// refresh updates endpoints from the resolver, keeping health state of
+// endpoints which are still present. The resolver is called without holding
+// the lock, so that a slow one doesn't block other calls.
+func (p *endpointPool) refresh(ctx context.Context) {
+	if p.resolver == nil {
+		return
+	}
+
+	p.lk.Lock()
+	if time.Since(p.resolvedAt) < resolveInterval {
+		p.lk.Unlock()
+		return
+	}
+	// set before resolving, so that concurrent calls don't resolve too
+	p.resolvedAt = time.Now()
+	p.lk.Unlock()
+
+	addrs, err := p.resolver(ctx)
+	if err != nil {
+		log.Warnw("resolving endpoints", "error", err)
+		return
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	known := map[string]*endpoint{}
+	for _, e := range p.endpoints {
+		known[e.addr] = e
+	}
+
+	var endpoints []*endpoint
+	for _, addr := range addrs {
+		if e, ok := known[addr]; ok {
+			endpoints = append(endpoints, e)
+			continue
+		}
+
+		ws, err := isWebsocketAddr(addr)
+		if err != nil || ws != p.websocket {
+			log.Warnw("ignoring resolved endpoint", "addr", addr, "error", err)
+			continue
+		}
+		endpoints = append(endpoints, &endpoint{addr: addr})
+	}
+
+	if len(endpoints) == 0 {
+		log.Warn("resolver returned no usable endpoints, keeping previous ones")
+		return
+	}
+	p.endpoints = endpoints
+}
+
+// pick selects an endpoint according to the balance policy and marks a call
+// as in-flight on it; release must be called when done. If no endpoint is
+// healthy, the one which will recover soonest is returned. Endpoints in skip
+// are only returned when there is nothing else left.
+func (p *endpointPool) pick(ctx context.Context, skip map[*endpoint]bool) *endpoint {
+	p.refresh(ctx)
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	now := time.Now()
+	var candidates []*endpoint
+	for _, e := range p.endpoints {
+		if e.healthy(now) && !skip[e] {
+			candidates = append(candidates, e)
+		}
+	}
+
+	var picked *endpoint
+	switch {
+	case len(candidates) == 0:
+		// nothing healthy, take the endpoint which recovers soonest
+		for _, e := range p.endpoints {
+			if !skip[e] {
+				candidates = append(candidates, e)
+			}
+		}
+		if len(candidates) == 0 {
+			candidates = p.endpoints
+		}
+		for _, e := range candidates {
+			if picked == nil || e.retryAt.Before(picked.retryAt) {
+				picked = e
+			}
+		}
+	case p.policy == Priority:
+		picked = candidates[0]
+	case p.policy == LeastInflight:
+		for _, e := range candidates {
+			if picked == nil || e.inflight < picked.inflight {
+				picked = e
+			}
+		}
+	default:
+		picked = candidates[p.rr%len(candidates)]
+		p.rr++
+	}
+
+	picked.inflight++
+	return picked
+}
+
+func (p *endpointPool) release(e *endpoint) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	e.inflight--
+}
+
+// markFailed makes the endpoint unhealthy for a backoff period growing with
+// consecutive failures
+func (p *endpointPool) markFailed(e *endpoint) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	e.retryAt = time.Now().Add(p.backoff.next(e.failures))
+	e.failures++
+}
+
+func (p *endpointPool) markOK(e *endpoint) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	e.failures = 0
+	e.retryAt = time.Time{}
+}
+
+func (p *endpointPool) size() int {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	return len(p.endpoints)
+}
+
+// isDialError returns true for errors which guarantee that the request never
+// reached the endpoint, making it safe to send it elsewhere
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return xerrors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,292 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"gitee.com/huanghua_2017/hggutils/jsonrpc/auth"
+	"golang.org/x/xerrors"
+)
+
+var rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+
+// GatewayRoute sends calls of methods in a namespace to a backend
+type GatewayRoute struct {
+	// Namespace is the prefix of methods routed to the backend, "Users"
+	// routes "Users.Get". When namespaces overlap the longest one is used.
+	Namespace string
+
+	// Addrs are endpoints of the backend, all ws(s) or all http(s), as taken
+	// by NewMultiClient
+	Addrs []string
+
+	// Header is sent to the backend, e.g. with a token of the gateway
+	Header http.Header
+
+	// Options configure the backend clients
+	Options []Option
+
+	// Conns is the number of clients calls to the backend are spread over,
+	// each keeping one connection with websocket endpoints. One when zero.
+	Conns int
+
+	// Channels lists the methods, with the namespace, which return
+	// channels. They must be known before calling the backend, to
+	// forward the channel.
+	Channels []string
+
+	// Perm is the permission callers need to call methods of the namespace
+	Perm auth.Permission
+}
+
+// GatewayConfig configures a Gateway
+type GatewayConfig struct {
+	Routes []GatewayRoute
+
+	// Verify checks tokens sent by callers and returns their permissions, as
+	// in auth.Handler. Callers without a token have no permissions, so they
+	// can't call namespaces which need one. Tokens aren't checked when nil.
+	Verify func(ctx context.Context, token string) ([]auth.Permission, error)
+}
+
+// Gateway is an http.Handler routing calls to backend RPC servers by the
+// namespace of the method. Clients connect to the gateway as they would to
+// an RPCServer, the gateway keeps its own connections to the backends, which
+// calls of all clients share. Channels, cancellation and request and response
+// metadata are forwarded; errors of the backends are returned as they are.
+//
+// Methods registered on the gateway are served by the gateway itself.
+type Gateway struct {
+	*RPCServer
+
+	handler http.Handler
+	// routes are sorted by namespace length, longest first
+	routes []*gatewayRoute
+}
+
+type gatewayRoute struct {
+	GatewayRoute
+	channels map[string]bool
+
+	lk       sync.Mutex
+	backends []*gatewayBackend
+	next     int
+	closed   bool
+}
+
+type gatewayBackend struct {
+	client *client
+	closer ClientCloser
+}
+
+// NewGateway creates a gateway for the routes, the options configure the
+// server clients connect to. Backends are connected on first use.
+func NewGateway(config GatewayConfig, opts ...ServerOption) (*Gateway, error) {
+	g := &Gateway{
+		RPCServer: NewServer(opts...),
+	}
+
+	seen := map[string]bool{}
+	for _, r := range config.Routes {
+		if r.Namespace == "" || len(r.Addrs) == 0 {
+			return nil, xerrors.Errorf("gateway route '%s': namespace and addrs must be set", r.Namespace)
+		}
+		if seen[r.Namespace] {
+			return nil, xerrors.Errorf("gateway route '%s': namespace routed twice", r.Namespace)
+		}
+		seen[r.Namespace] = true
+
+		conns := r.Conns
+		if conns <= 0 {
+			conns = 1
+		}
+		route := &gatewayRoute{
+			GatewayRoute: r,
+			channels:     map[string]bool{},
+			backends:     make([]*gatewayBackend, conns),
+		}
+		for _, m := range r.Channels {
+			route.channels[m] = true
+		}
+		g.routes = append(g.routes, route)
+	}
+	sort.Slice(g.routes, func(i, j int) bool {
+		return len(g.routes[i].Namespace) > len(g.routes[j].Namespace)
+	})
+
+	g.forward = g.forwardHandler
+
+	g.handler = g.RPCServer
+	if config.Verify != nil {
+		g.handler = &auth.Handler{
+			Verify: config.Verify,
+			Next:   g.RPCServer.ServeHTTP,
+		}
+	}
+	return g, nil
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.handler.ServeHTTP(w, r)
+}
+
+// Close closes connections to the backends, calls made after it fail.
+// Connections of clients are closed with Shutdown.
+func (g *Gateway) Close() {
+	for _, r := range g.routes {
+		r.lk.Lock()
+		r.closed = true
+		backends := r.backends
+		r.backends = nil
+		r.lk.Unlock()
+
+		for _, b := range backends {
+			if b != nil {
+				b.closer()
+			}
+		}
+	}
+}
+
+func (g *Gateway) route(method string) *gatewayRoute {
+	for _, r := range g.routes {
+		if strings.HasPrefix(method, r.Namespace+".") {
+			return r
+		}
+	}
+	return nil
+}
+
+// forwardHandler makes a handler calling the method on the backend, taking
+// and returning raw JSON
+func (g *Gateway) forwardHandler(method string, nParams int) (rpcHandler, bool) {
+	r := g.route(method)
+	if r == nil {
+		return rpcHandler{}, false
+	}
+
+	ins := make([]reflect.Type, 1+nParams)
+	ins[0] = contextType
+	for i := 1; i < len(ins); i++ {
+		ins[i] = rawMessageType
+	}
+	out := rawMessageType
+	if r.channels[method] {
+		out = reflect.ChanOf(reflect.RecvDir, rawMessageType)
+	}
+	ftyp := reflect.FuncOf(ins, []reflect.Type{out, errorType}, false)
+
+	h := rpcHandler{
+		paramReceivers: ins[1:],
+		nParams:        nParams,
+		handlerFunc: reflect.MakeFunc(ftyp, func(args []reflect.Value) []reflect.Value {
+			return r.call(method, ftyp, args)
+		}),
+		hasCtx: 1,
+		valOut: 0,
+		errOut: 1,
+		opts:   methodOptions{perm: r.Perm},
+	}
+	return h, true
+}
+
+// call forwards a call to a backend
+func (r *gatewayRoute) call(method string, ftyp reflect.Type, args []reflect.Value) []reflect.Value {
+	ctx := args[0].Interface().(context.Context)
+
+	fail := func(err error) []reflect.Value {
+		errv := reflect.New(errorType).Elem()
+		errv.Set(reflect.ValueOf(err))
+		return []reflect.Value{reflect.Zero(ftyp.Out(0)), errv}
+	}
+
+	b, err := r.backend()
+	if err != nil {
+		return fail(err)
+	}
+	fn, err := b.client.makeRpcFunc(reflect.StructField{Name: method, Type: ftyp})
+	if err != nil {
+		return fail(err)
+	}
+
+	// request metadata goes to the backend, response metadata comes back
+	reqMeta := RequestMeta(ctx)
+	if len(reqMeta) > 0 {
+		m := Meta(outgoingMeta(ctx))
+		for k, v := range reqMeta {
+			m[k] = v
+		}
+		ctx = context.WithValue(ctx, outMetaKey{}, m)
+	}
+	respMeta := Meta{}
+	ctx = WithResponseMeta(ctx, respMeta)
+
+	args[0] = reflect.ValueOf(ctx)
+	out := fn.Call(args)
+
+	for k, v := range respMeta {
+		SetResponseMeta(ctx, k, v)
+	}
+	return out
+}
+
+// backend returns the next backend client, connecting it when needed.
+// Connecting is done without holding the lock, so that a backend which can't
+// be reached doesn't hold up calls using connected clients.
+func (r *gatewayRoute) backend() (*gatewayBackend, error) {
+	r.lk.Lock()
+	if r.closed {
+		r.lk.Unlock()
+		return nil, xerrors.New("gateway closed")
+	}
+
+	i := r.next
+	r.next = (r.next + 1) % len(r.backends)
+
+	old := r.backends[i]
+	if old != nil {
+		select {
+		case <-old.client.exiting:
+			// gave up reconnecting, start over
+		default:
+			r.lk.Unlock()
+			return old, nil
+		}
+	}
+	r.lk.Unlock()
+
+	config := defaultConfig()
+	for _, o := range r.Options {
+		o(&config)
+	}
+	c, closer, err := newClient(context.Background(), r.Addrs, "", r.Header, config)
+	if err != nil {
+		return nil, xerrors.Errorf("connecting to the backend of '%s': %w", r.Namespace, err)
+	}
+	b := &gatewayBackend{client: c, closer: closer}
+
+	r.lk.Lock()
+	if r.closed {
+		r.lk.Unlock()
+		closer()
+		return nil, xerrors.New("gateway closed")
+	}
+	if cur := r.backends[i]; cur != old {
+		// another call connected first
+		r.lk.Unlock()
+		closer()
+		return cur, nil
+	}
+	r.backends[i] = b
+	r.lk.Unlock()
+
+	if old != nil {
+		old.closer()
+	}
+	return b, nil
+}
@@ -0,0 +1,313 @@
+package jsonrpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"gitee.com/huanghua_2017/hggutils/jsonrpc/metrics"
+	"github.com/gorilla/websocket"
+	"golang.org/x/xerrors"
+)
+
+// Clients set up with WithHTTPStream keep a full-duplex HTTP/2 stream to the
+// server instead of a websocket connection: a POST with streamHeader set, with
+// the request body carrying messages to the server and the response body
+// messages to the client, one per line. The messages are the same frames as on
+// websocket connections, so channels, cancellation and reverse calls work the
+// same, e.g. behind load balancers which only speak HTTP/2.
+//
+// Websocket control frames don't exist on streams. Keepalive is done with
+// xrpc.ping messages, closing a stream is done with a streamClose line, and
+// messages aren't chunked.
+const (
+	streamHeader = "X-Jsonrpc-Stream"
+	ndjsonType   = "application/x-ndjson"
+)
+
+// streamClose is the field of the last line sent on a stream, carrying the
+// websocket close code; frames never start with it
+const streamClose = `{"xrpc.close":`
+
+var (
+	errStreamTimeout    = xerrors.New("stream read timeout")
+	errStreamTooBig     = xerrors.New("stream message too big")
+	errStreamClosed     = xerrors.New("stream closed")
+	errStreamNotMessage = xerrors.New("only text messages can be sent on streams")
+)
+
+type streamCloseMsg struct {
+	Code int    `json:"xrpc.close"`
+	Text string `json:"text,omitempty"`
+}
+
+// streamAddr is the address of the peer of a stream
+type streamAddr string
+
+func (a streamAddr) Network() string { return "http2" }
+func (a streamAddr) String() string  { return string(a) }
+
+// streamConn is a msgConn over the bodies of an HTTP/2 stream
+type streamConn struct {
+	r         *bufio.Reader
+	body      io.Closer
+	readLimit int64
+	remote    net.Addr
+
+	wlk        sync.Mutex
+	w          io.Writer
+	flush      func()
+	closeWrite func() error
+	wclosed    bool
+
+	dlk      sync.Mutex
+	deadline *time.Timer
+	timedOut bool
+
+	closeOnce sync.Once
+	// abort tears down the stream, failing pending writes. It's called when
+	// reading fails, as the peer is gone, and on Close.
+	abort func()
+}
+
+func newStreamConn(body io.ReadCloser, w io.Writer, flush func(), closeWrite func() error, remote net.Addr, abort func()) *streamConn {
+	return &streamConn{
+		r:          bufio.NewReader(body),
+		body:       body,
+		remote:     remote,
+		w:          w,
+		flush:      flush,
+		closeWrite: closeWrite,
+		abort:      abort,
+	}
+}
+
+// ReadMessage reads the next line. A close line from the peer is returned as
+// a *websocket.CloseError.
+func (c *streamConn) ReadMessage() (int, []byte, error) {
+	var msg []byte
+	for {
+		line, err := c.r.ReadSlice('\n')
+		msg = append(msg, line...)
+		if c.readLimit > 0 && int64(len(msg)) > c.readLimit+1 {
+			return 0, nil, errStreamTooBig
+		}
+
+		switch err {
+		case nil:
+		case bufio.ErrBufferFull:
+			continue
+		default:
+			return 0, nil, c.readErr(err)
+		}
+
+		msg = msg[:len(msg)-1]
+		if len(msg) == 0 {
+			continue
+		}
+		if bytes.HasPrefix(msg, []byte(streamClose)) {
+			var cm streamCloseMsg
+			if err := json.Unmarshal(msg, &cm); err != nil {
+				return 0, nil, xerrors.Errorf("reading stream close: %w", err)
+			}
+			return 0, nil, &websocket.CloseError{Code: cm.Code, Text: cm.Text}
+		}
+		return websocket.TextMessage, msg, nil
+	}
+}
+
+func (c *streamConn) readErr(err error) error {
+	if c.abort != nil {
+		c.abort()
+	}
+
+	c.dlk.Lock()
+	defer c.dlk.Unlock()
+	if c.timedOut {
+		return errStreamTimeout
+	}
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF // the peer is gone without closing
+	}
+	return err
+}
+
+// WriteMessage writes a text message as a line. Close messages are written as
+// a close line, after which the write side of the stream is closed.
+func (c *streamConn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case websocket.TextMessage:
+		return c.writeLine(data, false)
+	case websocket.CloseMessage:
+		cm := streamCloseMsg{Code: websocket.CloseNoStatusReceived}
+		if len(data) >= 2 {
+			cm.Code = int(binary.BigEndian.Uint16(data))
+			cm.Text = string(data[2:])
+		}
+		line, err := json.Marshal(cm)
+		if err != nil {
+			return err
+		}
+		return c.writeLine(line, true)
+	}
+	return errStreamNotMessage
+}
+
+// WriteControl writes close messages, pings and pongs are dropped
+func (c *streamConn) WriteControl(messageType int, data []byte, _ time.Time) error {
+	if messageType == websocket.CloseMessage {
+		return c.WriteMessage(messageType, data)
+	}
+	return nil
+}
+
+func (c *streamConn) writeLine(data []byte, last bool) error {
+	c.wlk.Lock()
+	defer c.wlk.Unlock()
+	if c.wclosed {
+		return errStreamClosed
+	}
+
+	line := make([]byte, len(data)+1)
+	copy(line, data)
+	line[len(data)] = '\n'
+	if _, err := c.w.Write(line); err != nil {
+		return err
+	}
+	if c.flush != nil {
+		c.flush()
+	}
+
+	if last {
+		return c.closeWriteLocked()
+	}
+	return nil
+}
+
+func (c *streamConn) closeWriteLocked() error {
+	if c.wclosed {
+		return nil
+	}
+	c.wclosed = true
+	if c.closeWrite != nil {
+		return c.closeWrite()
+	}
+	return nil
+}
+
+// SetReadDeadline makes reads fail after t, by closing the read side
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.dlk.Lock()
+	defer c.dlk.Unlock()
+	if c.deadline != nil {
+		c.deadline.Stop()
+		c.deadline = nil
+	}
+	if t.IsZero() || c.timedOut {
+		return nil
+	}
+
+	c.deadline = time.AfterFunc(time.Until(t), func() {
+		c.dlk.Lock()
+		c.timedOut = true
+		c.dlk.Unlock()
+		_ = c.body.Close()
+	})
+	return nil
+}
+
+// SetReadLimit limits the length of lines read, it must be called before
+// reading
+func (c *streamConn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// SetPongHandler does nothing, there are no pongs on streams
+func (c *streamConn) SetPongHandler(func(appData string) error) {}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Close closes both sides of the stream
+func (c *streamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.wlk.Lock()
+		err = c.closeWriteLocked()
+		c.wlk.Unlock()
+
+		c.dlk.Lock()
+		if c.deadline != nil {
+			c.deadline.Stop()
+		}
+		c.dlk.Unlock()
+
+		if cerr := c.body.Close(); err == nil {
+			err = cerr
+		}
+		if c.abort != nil {
+			c.abort()
+		}
+	})
+	return err
+}
+
+// handleStream serves a stream opened by a client set up with WithHTTPStream
+func (s *RPCServer) handleStream(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if r.ProtoMajor < 2 || !ok {
+		// the request body never ends, don't wait for it
+		w.Header().Set("Connection", "close")
+		http.Error(w, "JSON-RPC streams require HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	w.Header().Set("Content-Type", ndjsonType)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// the response ends when the handler returns, once the connection is
+	// closed
+	c := newStreamConn(r.Body, w, flusher.Flush, nil, streamAddr(r.RemoteAddr), nil)
+	s.serveConn(ctx, c, metrics.RPCStreamConnections, false, false)
+}
+
+// dialStream opens a stream to the server at addr
+func dialStream(ctx context.Context, hc *http.Client, addr string, header http.Header) (msgConn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", addr, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header = header.Clone()
+	req.Header.Set(streamHeader, "1")
+	req.Header.Set("Content-Type", ndjsonType)
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, &errHTTPStatus{code: resp.StatusCode, status: resp.Status}
+	}
+
+	abort := func() {
+		cancel()
+		_ = pr.CloseWithError(errStreamClosed)
+	}
+	return newStreamConn(resp.Body, pw, nil, pw.Close, streamAddr(req.URL.Host), abort), nil
+}
@@ -3,19 +3,17 @@ package jsonrpc
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"reflect"
+	"time"
 
+	"gitee.com/huanghua_2017/hggutils/jsonrpc/auth"
 	"gitee.com/huanghua_2017/hggutils/jsonrpc/metrics"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
 	"go.opencensus.io/trace"
-	"go.opencensus.io/trace/propagation"
-	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 	"golang.org/x/xerrors"
 )
 
@@ -23,13 +21,17 @@ type rpcHandler struct {
 	paramReceivers []reflect.Type
 	nParams        int
 
-	receiver    reflect.Value
+	// handlerFunc is a bound method or a plain function
 	handlerFunc reflect.Value
 
 	hasCtx int
 
 	errOut int
 	valOut int
+
+	opts methodOptions
+	// cache is set for methods registered with MethodCache
+	cache *methodCache
 }
 
 // Request / response
@@ -49,8 +51,9 @@ type request struct {
 const DEFAULT_MAX_REQUEST_SIZE = 100 << 20 // 100 MiB
 
 type respError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
 }
 
 func (e *respError) Error() string {
@@ -61,61 +64,25 @@ func (e *respError) Error() string {
 }
 
 type response struct {
-	Jsonrpc string      `json:"jsonrpc"`
-	Result  interface{} `json:"result,omitempty"`
-	ID      int64       `json:"id"`
-	Error   *respError  `json:"error,omitempty"`
-}
-
-// Register
-
-func (s *RPCServer) register(namespace string, r interface{}) {
-	val := reflect.ValueOf(r)
-	//TODO: expect ptr
-
-	for i := 0; i < val.NumMethod(); i++ {
-		method := val.Type().Method(i)
-
-		funcType := method.Func.Type()
-		hasCtx := 0
-		if funcType.NumIn() >= 2 && funcType.In(1) == contextType {
-			hasCtx = 1
-		}
-
-		ins := funcType.NumIn() - 1 - hasCtx
-		recvs := make([]reflect.Type, ins)
-		for i := 0; i < ins; i++ {
-			recvs[i] = method.Type.In(i + 1 + hasCtx)
-		}
-
-		valOut, errOut, _ := processFuncOut(funcType)
-
-		s.methods[namespace+"."+method.Name] = rpcHandler{
-			paramReceivers: recvs,
-			nParams:        ins,
-
-			handlerFunc: method.Func,
-			receiver:    val,
-
-			hasCtx: hasCtx,
-
-			errOut: errOut,
-			valOut: valOut,
-		}
-	}
+	Jsonrpc string            `json:"jsonrpc"`
+	Result  interface{}       `json:"result,omitempty"`
+	ID      int64             `json:"id"`
+	Error   *respError        `json:"error,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
 }
 
 // Handle
 
 type rpcErrFunc func(wrtfun func(interface{}), req *request, code int, err error)
-type chanOut func(reflect.Value, int64) error
+type chanOut func(method string, ch reflect.Value, reqID int64) error
 
-func (s *RPCServer) handleReader(ctx context.Context, r io.Reader, w io.Writer, rpcError rpcErrFunc) {
+func (s *RPCServer) handleReader(ctx context.Context, r io.Reader, w io.Writer, rpcError rpcErrFunc, chOut chanOut) {
 	wf := func(v interface{}) {
 		msg, err := json.Marshal(v)
 		if err != nil {
 			log.Errorf("handle me: %v", err)
 		}
+		stats.Record(ctx, metrics.RPCResponseSize.M(int64(len(msg))))
 		w.Write(msg)
 	}
 
@@ -146,67 +113,99 @@ func (s *RPCServer) handleReader(ctx context.Context, r io.Reader, w io.Writer,
 		return
 	}
 
-	if err := json.NewDecoder(bufferedRequest).Decode(&req); err != nil {
+	if err := decodeMessage(bufferedRequest, &req, s.decodeFlags); err != nil {
 		rpcError(wf, &req, rpcParseError, xerrors.Errorf("unmarshaling request: %w", err))
 		return
 	}
 
-	s.handle(ctx, req, wf, rpcError, func(bool) {}, nil)
-}
+	ctx, _ = tag.New(ctx, tag.Upsert(metrics.RPCMethod, req.Method))
+	stats.Record(ctx, metrics.RPCRequestSize.M(reqSize))
 
-func doCall(methodName string, f reflect.Value, params []reflect.Value) (out []reflect.Value, err error) {
-	defer func() {
-		if i := recover(); i != nil {
-			err = xerrors.Errorf("panic in rpc method '%s': %s", methodName, i)
-			log.Desugar().WithOptions(zap.AddStacktrace(zapcore.ErrorLevel)).Sugar().Error(err)
-		}
-	}()
+	s.handle(ctx, req, wf, rpcError, func(bool) {}, chOut)
+}
 
-	out = f.Call(params)
-	return out, nil
+func (s *RPCServer) doCall(ctx context.Context, methodName string, f reflect.Value, params []reflect.Value) (out []reflect.Value, err error) {
+	err = s.protect(ctx, methodName, func() {
+		out = f.Call(params)
+	})
+	return out, err
 }
 
 func (s *RPCServer) getSpan(ctx context.Context, req request) (context.Context, *trace.Span) {
-	if req.Meta == nil {
-		return ctx, nil
-	}
-	if eSC, ok := req.Meta["SpanContext"]; ok {
-		bSC := make([]byte, base64.StdEncoding.DecodedLen(len(eSC)))
-		_, err := base64.StdEncoding.Decode(bSC, []byte(eSC))
-		if err != nil {
-			log.Errorf("SpanContext: decode", "error", err)
-			return ctx, nil
-		}
-		sc, ok := propagation.FromBinary(bSC)
-		if !ok {
-			log.Errorf("SpanContext: could not create span", "data", bSC)
-			return ctx, nil
-		}
-		ctx, span := trace.StartSpanWithRemoteParent(ctx, "api.handle", sc)
-		span.AddAttributes(trace.StringAttribute("method", req.Method))
-		return ctx, span
+	var span *trace.Span
+	if sc, ok := remoteSpanContext(ctx, req.Meta); ok {
+		ctx, span = trace.StartSpanWithRemoteParent(ctx, "api.handle", sc, trace.WithSpanKind(trace.SpanKindServer))
+	} else {
+		ctx, span = trace.StartSpan(ctx, "api.handle", trace.WithSpanKind(trace.SpanKindServer))
 	}
-	return ctx, nil
+	span.AddAttributes(trace.StringAttribute("method", req.Method))
+	return ctx, span
 }
 
 func (s *RPCServer) handle(ctx context.Context, req request, wrtfun func(interface{}), rpcError rpcErrFunc, done func(keepCtx bool), chOut chanOut) {
 	// Not sure if we need to sanitize the incoming req.Method or not.
 	ctx, span := s.getSpan(ctx, req)
-	ctx, _ = tag.New(ctx, tag.Insert(metrics.RPCMethod, req.Method))
+	ctx, _ = tag.New(ctx, tag.Upsert(metrics.RPCMethod, req.Method))
 	defer span.End()
 
-	handler, ok := s.methods[req.Method]
+	ctx, respMeta := withHandlerMeta(ctx, req.Meta)
+
+	rpcErrorOut := rpcError
+	rpcError = func(wrtfun func(interface{}), req *request, code int, err error) {
+		setSpanError(span, code, err.Error())
+		rpcErrorOut(wrtfun, req, code, err)
+	}
+
+	if s.recorder != nil && req.ID != nil && ctx.Value(replayKey{}) == nil {
+		wrtfun = s.recorder.wrap(ctx, req, wrtfun)
+	}
+
+	start := time.Now()
+	stats.Record(ctx, metrics.RPCRequests.M(1), metrics.RPCRequestsInFlight.M(1))
+	defer func() {
+		stats.Record(ctx,
+			metrics.RPCRequestsInFlight.M(-1),
+			metrics.RPCRequestDuration.M(float64(time.Since(start))/float64(time.Millisecond)))
+	}()
+
+	ctx, cancelCall := context.WithCancel(ctx)
+	endCall, ok := s.startCall(cancelCall)
 	if !ok {
-		aliasTo, ok := s.aliasedMethods[req.Method]
-		if ok {
-			handler, ok = s.methods[aliasTo]
-		}
-		if !ok {
-			rpcError(wrtfun, &req, rpcMethodNotFound, fmt.Errorf("method '%s' not found", req.Method))
-			stats.Record(ctx, metrics.RPCInvalidMethod.M(1))
-			done(false)
-			return
+		cancelCall()
+		rpcError(wrtfun, &req, rpcShuttingDown, xerrors.New("server shutting down"))
+		done(false)
+		return
+	}
+	// endCall is left to doCallTimeout for calls which time out
+	defer func() {
+		endCall()
+	}()
+
+	// the context of calls returning channels lives on with the channel
+	outCh := false
+	defer func() {
+		if !outCh {
+			cancelCall()
 		}
+	}()
+
+	handler, methodName, ok := s.lookupMethod(req.Method)
+	if !ok && s.forward != nil {
+		handler, ok = s.forward(req.Method, len(req.Params))
+		methodName = req.Method
+	}
+	if !ok {
+		rpcError(wrtfun, &req, rpcMethodNotFound, fmt.Errorf("method '%s' not found", req.Method))
+		stats.Record(ctx, metrics.RPCInvalidMethod.M(1))
+		done(false)
+		return
+	}
+
+	if perm := handler.opts.perm; perm != "" && !auth.HasPerm(ctx, nil, perm) {
+		rpcError(wrtfun, &req, rpcPermissionDenied, xerrors.Errorf("missing permission to invoke '%s' (need '%s')", req.Method, perm))
+		stats.Record(ctx, metrics.RPCRequestError.M(1))
+		done(false)
+		return
 	}
 
 	if len(req.Params) != handler.nParams {
@@ -216,7 +215,7 @@ func (s *RPCServer) handle(ctx context.Context, req request, wrtfun func(interfa
 		return
 	}
 
-	outCh := handler.valOut != -1 && handler.handlerFunc.Type().Out(handler.valOut).Kind() == reflect.Chan
+	outCh = handler.valOut != -1 && handler.handlerFunc.Type().Out(handler.valOut).Kind() == reflect.Chan
 	defer done(outCh)
 
 	if chOut == nil && outCh {
@@ -225,12 +224,110 @@ func (s *RPCServer) handle(ctx context.Context, req request, wrtfun func(interfa
 		return
 	}
 
-	callParams := make([]reflect.Value, 1+handler.hasCtx+handler.nParams)
-	callParams[0] = handler.receiver
+	if cache := s.cacheFor(methodName, handler); cache != nil && req.ID != nil && !outCh {
+		// params which aren't valid JSON fail when decoding them below
+		if ckey, err := cache.key(ctx, req.Params); err == nil {
+			var call *cacheCall
+			for {
+				cached, c, owner := cache.begin(ckey)
+				if owner {
+					call = c
+					break
+				}
+
+				if cached == nil {
+					select {
+					case <-c.done:
+					case <-ctx.Done():
+						rpcError(wrtfun, &req, rpcTimeout, xerrors.Errorf("waiting for call with the same params: %w", ctx.Err()))
+						return
+					}
+					cached = c.resp
+				}
+				if cached != nil {
+					stats.Record(ctx, metrics.RPCCacheHits.M(1))
+					resp := *cached
+					resp.ID = *req.ID
+					wrtfun(resp)
+					return
+				}
+			}
+			stats.Record(ctx, metrics.RPCCacheMisses.M(1))
+
+			// share successful responses, errors such as the call being
+			// cancelled by its client only concern this call. Response
+			// metadata is set for each call, so it isn't shared.
+			var shared *response
+			wrtfunOut := wrtfun
+			wrtfun = func(v interface{}) {
+				if r, ok := v.(response); ok && r.Error == nil {
+					r.Meta = nil
+					shared = &r
+				}
+				wrtfunOut(v)
+			}
+			defer func() {
+				cache.finish(ckey, call, shared)
+			}()
+		}
+	}
+
+	if key, ok := req.Meta[metaIdempotencyKey]; ok && s.dedup != nil && req.ID != nil && !outCh {
+		dkey := s.dedup.key(ctx, methodName, key)
+
+		var entry *dedupEntry
+		for {
+			e, owner := s.dedup.begin(dkey)
+			if owner {
+				entry = e
+				break
+			}
+
+			select {
+			case <-e.done:
+			case <-ctx.Done():
+				rpcError(wrtfun, &req, rpcTimeout, xerrors.Errorf("waiting for call with the same idempotency key: %w", ctx.Err()))
+				return
+			}
+			if e.resp != nil {
+				resp := *e.resp
+				resp.ID = *req.ID
+				wrtfun(resp)
+				return
+			}
+		}
+
+		// remember responses of calls which reached the handler
+		var replay *response
+		wrtfunOut := wrtfun
+		wrtfun = func(v interface{}) {
+			if r, ok := v.(response); ok && (r.Error == nil || r.Error.Code == 1) {
+				replay = &r
+			}
+			wrtfunOut(v)
+		}
+		defer func() {
+			s.dedup.finish(dkey, entry, replay)
+		}()
+	}
+
+	timeout, hasTimeout := s.callTimeout(methodName, handler.opts.timeout, req.Meta, outCh)
+	cancel := func() {}
+	if hasTimeout {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer func() {
+		if !outCh {
+			cancel()
+		}
+	}()
+
+	callParams := make([]reflect.Value, handler.hasCtx+handler.nParams)
 	if handler.hasCtx == 1 {
-		callParams[1] = reflect.ValueOf(ctx)
+		callParams[0] = reflect.ValueOf(ctx)
 	}
 
+	var verrs ValidationErrors
 	for i := 0; i < handler.nParams; i++ {
 		var rp reflect.Value
 
@@ -238,7 +335,7 @@ func (s *RPCServer) handle(ctx context.Context, req request, wrtfun func(interfa
 		dec, found := s.paramDecoders[typ]
 		if !found {
 			rp = reflect.New(typ)
-			if err := json.NewDecoder(bytes.NewReader(req.Params[i].data)).Decode(rp.Interface()); err != nil {
+			if err := decodeValue(req.Params[i].data, rp.Interface(), s.decodeFlags); err != nil {
 				rpcError(wrtfun, &req, rpcParseError, xerrors.Errorf("unmarshaling params for '%s' (param: %T): %w", req.Method, rp.Interface(), err))
 				stats.Record(ctx, metrics.RPCRequestError.M(1))
 				return
@@ -254,12 +351,52 @@ func (s *RPCServer) handle(ctx context.Context, req request, wrtfun func(interfa
 			}
 		}
 
-		callParams[i+1+handler.hasCtx] = reflect.ValueOf(rp.Interface())
+		if s.validateParams {
+			// Validate methods are user code, panics are handled like panics
+			// in the method
+			var perrs ValidationErrors
+			err := s.protect(ctx, req.Method, func() {
+				perrs = validateParam(fmt.Sprintf("params[%d]", i), rp)
+			})
+			var perr *PanicError
+			if xerrors.As(err, &perr) {
+				rpcError(wrtfun, &req, rpcPanic, xerrors.Errorf("fatal error validating params for '%s': %w", req.Method, s.panicMessage(perr)))
+				stats.Record(ctx, metrics.RPCRequestError.M(1))
+				return
+			}
+			verrs = append(verrs, perrs...)
+		}
+
+		callParams[i+handler.hasCtx] = reflect.ValueOf(rp.Interface())
+	}
+
+	if len(verrs) > 0 {
+		rpcError(wrtfun, &req, rpcInvalidParams, xerrors.Errorf("invalid params for '%s': %w", req.Method, verrs))
+		stats.Record(ctx, metrics.RPCRequestError.M(1))
+		return
 	}
 
 	///////////////////
 
-	callResult, err := doCall(req.Method, handler.handlerFunc, callParams)
+	var callResult []reflect.Value
+	var err error
+	if hasTimeout && !outCh {
+		callResult, err = s.doCallTimeout(ctx, req.Method, handler.handlerFunc, callParams, endCall)
+	} else {
+		callResult, err = s.doCall(ctx, req.Method, handler.handlerFunc, callParams)
+	}
+	if err == errCallTimeout {
+		endCall = func() {}
+		rpcError(wrtfun, &req, rpcTimeout, xerrors.Errorf("calling '%s': %w", req.Method, err))
+		stats.Record(ctx, metrics.RPCRequestError.M(1))
+		return
+	}
+	var perr *PanicError
+	if xerrors.As(err, &perr) {
+		rpcError(wrtfun, &req, rpcPanic, xerrors.Errorf("fatal error calling '%s': %w", req.Method, s.panicMessage(perr)))
+		stats.Record(ctx, metrics.RPCRequestError.M(1))
+		return
+	}
 	if err != nil {
 		rpcError(wrtfun, &req, 0, xerrors.Errorf("fatal error calling '%s': %w", req.Method, err))
 		stats.Record(ctx, metrics.RPCRequestError.M(1))
@@ -276,22 +413,39 @@ func (s *RPCServer) handle(ctx context.Context, req request, wrtfun func(interfa
 		ID:      *req.ID,
 	}
 
+	methodErr := false
 	if handler.errOut != -1 {
 		err := callResult[handler.errOut].Interface()
 		if err != nil {
 			log.Warnf("error in RPC call to '%s': %+v", req.Method, err)
 			stats.Record(ctx, metrics.RPCResponseError.M(1))
+			code := 1
+			if ctx.Err() == context.DeadlineExceeded {
+				code = rpcTimeout
+			}
 			resp.Error = &respError{
-				Code:    1,
+				Code:    code,
 				Message: err.(error).Error(),
 			}
+			if rerr, ok := err.(*respError); ok {
+				// errors of calls to other servers, returned as they are,
+				// keep their code, e.g. when forwarded by a Gateway
+				resp.Error = &respError{
+					Code:    rerr.Code,
+					Message: rerr.Message,
+					Data:    rerr.Data,
+				}
+			}
+			methodErr = true
 		}
 	}
 
 	var kind reflect.Kind
 	var res interface{}
 	var nonZero bool
+	var outType reflect.Type
 	if handler.valOut != -1 {
+		outType = handler.handlerFunc.Type().Out(handler.valOut)
 		res = callResult[handler.valOut].Interface()
 		kind = callResult[handler.valOut].Kind()
 		nonZero = !callResult[handler.valOut].IsZero()
@@ -304,8 +458,13 @@ func (s *RPCServer) handle(ctx context.Context, req request, wrtfun func(interfa
 			// Sending responses here could cause deadlocks on writeLk, or allow
 			// sending channel messages before this rpc call returns
 
+			ch := callResult[handler.valOut]
+			if enc, found := s.resultEncoders[outType.Elem()]; found {
+				ch = encodeChanResults(ctx, enc, ch)
+			}
+
 			//noinspection GoNilness // already checked above
-			err = chOut(callResult[handler.valOut], *req.ID)
+			err = chOut(req.Method, ch, *req.ID)
 			if err == nil {
 				return // channel goroutine handles responding
 			}
@@ -316,13 +475,33 @@ func (s *RPCServer) handle(ctx context.Context, req request, wrtfun func(interfa
 				Code:    1,
 				Message: err.(error).Error(),
 			}
-		} else {
-			resp.Result = res
+		} else if res != nil {
+			// marshal here, so that results which can't be encoded are
+			// reported to the client
+			var data []byte
+			rv, err := encodeResult(s.resultEncoders, outType, callResult[handler.valOut])
+			if err == nil {
+				data, err = json.Marshal(rv.Interface())
+			}
+			if err != nil {
+				log.Errorf("encoding result of RPC call to '%s': %+v", req.Method, err)
+				stats.Record(ctx, metrics.RPCResponseError.M(1))
+				resp.Error = &respError{
+					Code:    rpcInternalError,
+					Message: fmt.Sprintf("encoding result: %s", err),
+				}
+			} else {
+				resp.Result = json.RawMessage(data)
+			}
 		}
 	}
-	if resp.Error != nil && nonZero {
-		log.Errorw("error and res returned", "request", req, "r.err", resp.Error, "res", res)
+	if resp.Error != nil {
+		setSpanError(span, resp.Error.Code, resp.Error.Message)
+		if methodErr && nonZero {
+			log.Errorw("error and res returned", "request", req, "r.err", resp.Error, "res", res)
+		}
 	}
+	resp.Meta = respMeta.get()
 
 	wrtfun(resp)
 }
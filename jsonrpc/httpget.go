@@ -0,0 +1,161 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// defaultCacheControl makes caches revalidate GET responses using the ETag
+const defaultCacheControl = "no-cache"
+
+// readOnlyMethod returns the Cache-Control value for a method callable with
+// GET requests
+func (s *RPCServer) readOnlyMethod(method string) (string, bool) {
+	handler, name, found := s.lookupMethod(method)
+	if !found {
+		return "", false
+	}
+
+	cc, ok := s.readOnly[name]
+	if !ok && handler.opts.readOnly {
+		cc, ok = handler.opts.cacheControl, true
+	}
+	if ok && cc == "" {
+		cc = defaultCacheControl
+	}
+	return cc, ok
+}
+
+// decodeGetParams decodes the params query value, which is either a JSON
+// array or a base64url encoded JSON array
+func decodeGetParams(raw string) ([]param, error) {
+	if raw == "" {
+		return []param{}, nil
+	}
+
+	data := []byte(raw)
+	if !strings.HasPrefix(raw, "[") {
+		var err error
+		data, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(raw, "="))
+		if err != nil {
+			return nil, xerrors.Errorf("decoding base64 params: %w", err)
+		}
+	}
+
+	var params []param
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, xerrors.Errorf("unmarshaling params: %w", err)
+	}
+	return params, nil
+}
+
+// etagMatches checks an If-None-Match header against an ETag
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// handleGet serves calls to read-only methods made with GET requests, like
+// /rpc?method=Namespace.Method&params=[1,"a"]&id=1
+func (s *RPCServer) handleGet(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	method := q.Get("method")
+
+	cacheControl, ok := s.readOnlyMethod(method)
+	if !ok {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not callable with GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if int64(len(r.URL.RawQuery)) > s.maxRequestSize {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var id int64
+	if v := q.Get("id"); v != "" {
+		var err error
+		if id, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	req := request{
+		Jsonrpc: "2.0",
+		ID:      &id,
+		Method:  method,
+	}
+
+	var buf bytes.Buffer
+	wf := func(v interface{}) {
+		msg, err := json.Marshal(v)
+		if err != nil {
+			log.Errorf("marshaling response: %v", err)
+		}
+		buf.Write(msg)
+	}
+
+	failed := false
+	erf := func(wrtfun func(interface{}), req *request, code int, err error) {
+		failed = true
+		rpcError(wrtfun, req, code, err)
+	}
+
+	params, err := decodeGetParams(q.Get("params"))
+	if err != nil {
+		erf(wf, &req, rpcParseError, err)
+	} else {
+		req.Params = params
+		s.handle(ctx, req, wf, erf, func(bool) {}, nil)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if failed {
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(buf.Bytes())
+		return
+	}
+
+	// responses with errors returned from the method aren't cached either
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *respError      `json:"error"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &resp); err != nil || resp.Error != nil {
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write(buf.Bytes())
+		return
+	}
+
+	// the ETag is computed from the result only, the id and metadata differ
+	// between requests for the same result
+	sum := sha256.Sum256(resp.Result)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,224 @@
+package jsonrpctest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gitee.com/huanghua_2017/hggutils/jsonrpc"
+)
+
+// Faults injects faults into websocket connections of a Server. Faults on
+// the server side of connections apply to all clients, dial failures only to
+// clients created with ClientOption.
+type Faults struct {
+	lk        sync.Mutex
+	delay     time.Duration
+	corrupt   int
+	failDials int
+	conns     map[*faultConn]struct{}
+}
+
+func newFaults() *Faults {
+	return &Faults{
+		conns: map[*faultConn]struct{}{},
+	}
+}
+
+// Delay delays each message sent by the server by d, zero disables the delay
+func (f *Faults) Delay(d time.Duration) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.delay = d
+}
+
+// DropConnections closes all websocket connections to the server, clients
+// reconnect unless set up not to
+func (f *Faults) DropConnections() {
+	f.lk.Lock()
+	conns := f.conns
+	f.conns = map[*faultConn]struct{}{}
+	f.lk.Unlock()
+
+	for c := range conns {
+		_ = c.Conn.Close()
+	}
+}
+
+// CorruptFrames corrupts the next n text messages sent by the server, so
+// that clients get invalid JSON instead
+func (f *Faults) CorruptFrames(n int) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.corrupt += n
+}
+
+// FailDials makes the next n connection attempts of clients created with
+// ClientOption fail, e.g. to test reconnect backoff
+func (f *Faults) FailDials(n int) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.failDials += n
+}
+
+// ClientOption returns a client option applying FailDials, using
+// jsonrpc.WithConnFactory
+func (f *Faults) ClientOption() jsonrpc.Option {
+	return jsonrpc.WithConnFactory(func(dial func() (*websocket.Conn, error)) func() (*websocket.Conn, error) {
+		return func() (*websocket.Conn, error) {
+			f.lk.Lock()
+			fail := f.failDials > 0
+			if fail {
+				f.failDials--
+			}
+			f.lk.Unlock()
+
+			if fail {
+				return nil, errors.New("jsonrpctest: injected dial failure")
+			}
+			return dial()
+		}
+	})
+}
+
+func (f *Faults) takeCorrupt() bool {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	if f.corrupt == 0 {
+		return false
+	}
+	f.corrupt--
+	return true
+}
+
+func (f *Faults) getDelay() time.Duration {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return f.delay
+}
+
+// wrap makes websocket connections to h go through faultConn
+func (f *Faults) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hj, ok := w.(http.Hijacker); ok && r.Header.Get("Upgrade") == "websocket" {
+			w = &hijackWriter{ResponseWriter: w, hj: hj, f: f}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type hijackWriter struct {
+	http.ResponseWriter
+	hj http.Hijacker
+	f  *Faults
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fc := &faultConn{Conn: conn, f: w.f}
+	w.f.lk.Lock()
+	w.f.conns[fc] = struct{}{}
+	w.f.lk.Unlock()
+
+	return fc, brw, nil
+}
+
+// faultConn is the server side of a websocket connection. Outgoing frames
+// are followed to find payloads to corrupt; the websocket library writes
+// frame headers whole.
+type faultConn struct {
+	net.Conn
+	f *Faults
+
+	handshake bool   // the handshake response was written
+	remaining uint64 // payload bytes left in the current frame
+	corrupt   bool   // the payload of the current frame is to be corrupted
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	if !c.handshake {
+		c.handshake = true
+		return c.Conn.Write(p)
+	}
+
+	if d := c.f.getDelay(); d > 0 {
+		time.Sleep(d)
+	}
+
+	out, copied := p, false
+	for i := 0; i < len(p); {
+		if c.remaining == 0 {
+			n, hdr, ok := frameHeader(p[i:])
+			if !ok {
+				break // not a frame start, stop following
+			}
+			c.remaining = n
+			c.corrupt = p[i]&0x0f == websocket.TextMessage && n > 0 && c.f.takeCorrupt()
+			i += hdr
+			continue
+		}
+
+		if c.corrupt {
+			if !copied {
+				out, copied = append([]byte(nil), p...), true
+			}
+			out[i] = '#' // not valid JSON
+			c.corrupt = false
+		}
+
+		k := uint64(len(p) - i)
+		if k > c.remaining {
+			k = c.remaining
+		}
+		c.remaining -= k
+		i += int(k)
+	}
+
+	return c.Conn.Write(out)
+}
+
+func (c *faultConn) Close() error {
+	c.f.lk.Lock()
+	delete(c.f.conns, c)
+	c.f.lk.Unlock()
+
+	return c.Conn.Close()
+}
+
+// frameHeader parses the header of a websocket frame, returning the payload
+// length and the header length
+func frameHeader(p []byte) (n uint64, hdr int, ok bool) {
+	if len(p) < 2 {
+		return 0, 0, false
+	}
+
+	hdr = 2
+	switch l := p[1] & 0x7f; l {
+	case 126:
+		if len(p) < 4 {
+			return 0, 0, false
+		}
+		n, hdr = uint64(binary.BigEndian.Uint16(p[2:])), 4
+	case 127:
+		if len(p) < 10 {
+			return 0, 0, false
+		}
+		n, hdr = binary.BigEndian.Uint64(p[2:]), 10
+	default:
+		n = uint64(l)
+	}
+	if p[1]&0x80 != 0 { // masked
+		hdr += 4
+	}
+	return n, hdr, len(p) >= hdr
+}
@@ -0,0 +1,465 @@
+// Package jsonrpctest provides a scriptable JSON-RPC server for testing code
+// which uses jsonrpc clients, without implementing the real server.
+//
+//	srv := jsonrpctest.NewServer(t)
+//	srv.Expect("Users.Get", 1).Return(User{Name: "bob"})
+//	srv.ExpectStream("Users.Watch", jsonrpctest.Any).Stream(1, 2, 3)
+//
+//	closer, err := jsonrpc.NewClient(ctx, srv.WSURL, "Users", &client, nil)
+//	// ... exercise code using the client
+//
+//	srv.AssertExpectations(t)
+package jsonrpctest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitee.com/huanghua_2017/hggutils/jsonrpc"
+)
+
+// UpdateGoldenEnv is the environment variable which makes AssertGolden
+// write golden files instead of comparing with them
+const UpdateGoldenEnv = "JSONRPCTEST_UPDATE"
+
+type anyParam struct{}
+
+// Any matches any value of a param in Expect
+var Any interface{} = anyParam{}
+
+var (
+	contextType = reflect.TypeOf(new(context.Context)).Elem()
+	rawType     = reflect.TypeOf(json.RawMessage{})
+	rawChanType = reflect.ChanOf(reflect.RecvDir, rawType)
+	errorType   = reflect.TypeOf(new(error)).Elem()
+)
+
+// Server is a mock JSON-RPC server. Calls are answered as scripted with
+// Expect, calls no expectation matches fail the test. The server is closed
+// when the test ends.
+type Server struct {
+	// URL and WSURL are addresses of the server, for HTTP and websocket
+	// clients
+	URL   string
+	WSURL string
+
+	// Faults injects faults into connections to the server
+	Faults *Faults
+
+	t    testing.TB
+	rpc  *jsonrpc.RPCServer
+	http *httptest.Server
+
+	lk       sync.Mutex
+	expected []*Call
+	methods  map[string]method
+	calls    []RecordedCall
+}
+
+type method struct {
+	nParams int
+	stream  bool
+}
+
+// Call is an expected call, set up with Server.Expect or Server.ExpectStream
+type Call struct {
+	s *Server
+
+	method   string
+	params   []json.RawMessage // nil for Any
+	isStream bool
+
+	result json.RawMessage
+	err    string
+	stream []json.RawMessage
+	delay  time.Duration
+
+	times int
+	calls int
+}
+
+// RecordedCall is a call received by the server
+type RecordedCall struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+
+	// Unexpected is set for calls no expectation matched
+	Unexpected bool `json:"unexpected,omitempty"`
+}
+
+// NewServer starts a mock server, options are passed to the underlying
+// jsonrpc.RPCServer
+func NewServer(t testing.TB, opts ...jsonrpc.ServerOption) *Server {
+	s := &Server{
+		Faults:  newFaults(),
+		t:       t,
+		rpc:     jsonrpc.NewServer(opts...),
+		methods: map[string]method{},
+	}
+
+	s.http = httptest.NewServer(s.Faults.wrap(s.rpc))
+	s.URL = s.http.URL
+	s.WSURL = "ws://" + strings.TrimPrefix(s.http.URL, "http://")
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.http.CloseClientConnections()
+	s.http.Close()
+}
+
+// Expect sets up an expected call of the method with the params, matched
+// by their JSON encoding. Use Any for params which can have any value. The
+// call returns nothing, unless set up with Return or ReturnError.
+func (s *Server) Expect(name string, params ...interface{}) *Call {
+	s.t.Helper()
+	return s.expect(name, params, false)
+}
+
+// ExpectStream is like Expect, for methods returning channels. The channel
+// is closed right away, unless values are set with Stream.
+func (s *Server) ExpectStream(name string, params ...interface{}) *Call {
+	s.t.Helper()
+	return s.expect(name, params, true)
+}
+
+func (s *Server) expect(name string, params []interface{}, stream bool) *Call {
+	s.t.Helper()
+
+	c := &Call{
+		s:        s,
+		method:   name,
+		params:   make([]json.RawMessage, len(params)),
+		isStream: stream,
+		times:    1,
+	}
+	for i, p := range params {
+		if p == Any {
+			continue
+		}
+		b, err := json.Marshal(p)
+		if err != nil {
+			s.t.Fatalf("jsonrpctest: marshaling param %d of %s: %s", i, name, err)
+		}
+		c.params[i] = b
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if m, ok := s.methods[name]; ok {
+		if m.nParams != len(params) {
+			s.t.Fatalf("jsonrpctest: %s expected with %d params, and before with %d", name, len(params), m.nParams)
+		}
+		if m.stream != stream {
+			s.t.Fatalf("jsonrpctest: %s expected with both Expect and ExpectStream", name)
+		}
+	} else {
+		s.methods[name] = method{nParams: len(params), stream: stream}
+		if err := s.register(name, len(params), stream); err != nil {
+			s.t.Fatalf("jsonrpctest: %s", err)
+		}
+	}
+
+	s.expected = append(s.expected, c)
+	return c
+}
+
+// register registers a method taking n params of any type, returning a
+// value or a channel
+func (s *Server) register(name string, n int, stream bool) error {
+	ins := []reflect.Type{contextType}
+	for i := 0; i < n; i++ {
+		ins = append(ins, rawType)
+	}
+	out := rawType
+	if stream {
+		out = rawChanType
+	}
+	ftyp := reflect.FuncOf(ins, []reflect.Type{out, errorType}, false)
+
+	fn := reflect.MakeFunc(ftyp, func(args []reflect.Value) []reflect.Value {
+		params := make([]json.RawMessage, n)
+		for i := range params {
+			params[i] = args[i+1].Interface().(json.RawMessage)
+		}
+
+		res, err := s.call(args[0].Interface().(context.Context), name, params)
+		errv := reflect.Zero(errorType)
+		if err != nil {
+			errv = reflect.ValueOf(&err).Elem()
+		}
+		if !res.IsValid() {
+			res = reflect.Zero(out)
+		}
+		return []reflect.Value{res, errv}
+	})
+
+	return s.rpc.TryRegisterFunc(name, fn.Interface())
+}
+
+// call answers a call with the first matching expectation
+func (s *Server) call(ctx context.Context, name string, params []json.RawMessage) (reflect.Value, error) {
+	s.lk.Lock()
+	var c *Call
+	for _, e := range s.expected {
+		if e.method == name && (e.times <= 0 || e.calls < e.times) && paramsMatch(e.params, params) {
+			c = e
+			break
+		}
+	}
+
+	s.calls = append(s.calls, RecordedCall{Method: name, Params: params, Unexpected: c == nil})
+	if c == nil {
+		s.lk.Unlock()
+		s.t.Errorf("jsonrpctest: unexpected call %s(%s)", name, joinParams(params))
+		return reflect.Value{}, fmt.Errorf("jsonrpctest: unexpected call to %s", name)
+	}
+	c.calls++
+	result, errMsg, stream, delay := c.result, c.err, c.stream, c.delay
+	s.lk.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return reflect.Value{}, ctx.Err()
+		}
+	}
+
+	if errMsg != "" {
+		return reflect.Value{}, errors.New(errMsg)
+	}
+	if c.isStream {
+		ch := make(chan json.RawMessage, len(stream))
+		for _, v := range stream {
+			ch <- v
+		}
+		close(ch)
+		return reflect.ValueOf((<-chan json.RawMessage)(ch)), nil
+	}
+	return reflect.ValueOf(result), nil
+}
+
+// Return sets the result of the call
+func (c *Call) Return(v interface{}) *Call {
+	c.s.t.Helper()
+
+	if c.isStream {
+		c.s.t.Fatalf("jsonrpctest: Return used for %s, which returns a channel", c.method)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		c.s.t.Fatalf("jsonrpctest: marshaling result of %s: %s", c.method, err)
+	}
+
+	c.s.lk.Lock()
+	defer c.s.lk.Unlock()
+	c.result = b
+	return c
+}
+
+// ReturnError makes the call fail with the error
+func (c *Call) ReturnError(err error) *Call {
+	c.s.lk.Lock()
+	defer c.s.lk.Unlock()
+	c.err = err.Error()
+	return c
+}
+
+// Stream sets values received on the channel returned by the call, before
+// it's closed
+func (c *Call) Stream(values ...interface{}) *Call {
+	c.s.t.Helper()
+
+	if !c.isStream {
+		c.s.t.Fatalf("jsonrpctest: Stream used for %s, use ExpectStream for methods returning channels", c.method)
+	}
+
+	raw := make([]json.RawMessage, len(values))
+	for i, v := range values {
+		b, err := json.Marshal(v)
+		if err != nil {
+			c.s.t.Fatalf("jsonrpctest: marshaling value %d of %s: %s", i, c.method, err)
+		}
+		raw[i] = b
+	}
+
+	c.s.lk.Lock()
+	defer c.s.lk.Unlock()
+	c.stream = raw
+	return c
+}
+
+// Delay makes the server wait before answering the call
+func (c *Call) Delay(d time.Duration) *Call {
+	c.s.lk.Lock()
+	defer c.s.lk.Unlock()
+	c.delay = d
+	return c
+}
+
+// Times sets how many times the call is expected, it's expected once by
+// default. With n <= 0 it can be made any number of times, including none.
+func (c *Call) Times(n int) *Call {
+	c.s.lk.Lock()
+	defer c.s.lk.Unlock()
+	c.times = n
+	return c
+}
+
+// Calls returns calls received so far, in order
+func (s *Server) Calls() []RecordedCall {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return append([]RecordedCall(nil), s.calls...)
+}
+
+// AssertExpectations checks that all expected calls were made as many times
+// as expected
+func (s *Server) AssertExpectations(t testing.TB) bool {
+	t.Helper()
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	ok := true
+	for _, c := range s.expected {
+		if c.times > 0 && c.calls != c.times {
+			t.Errorf("jsonrpctest: expected %d calls of %s(%s), got %d", c.times, c.method, joinParams(c.params), c.calls)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// AssertCalled checks that the method was called n times
+func (s *Server) AssertCalled(t testing.TB, method string, n int) bool {
+	t.Helper()
+
+	got := 0
+	for _, c := range s.Calls() {
+		if c.Method == method {
+			got++
+		}
+	}
+	if got != n {
+		t.Errorf("jsonrpctest: expected %d calls of %s, got %d", n, method, got)
+		return false
+	}
+	return true
+}
+
+// AssertCallOrder checks that the methods were called in the order given.
+// Other calls may be made in between.
+func (s *Server) AssertCallOrder(t testing.TB, methods ...string) bool {
+	t.Helper()
+
+	calls := s.Calls()
+	next := 0
+	for _, c := range calls {
+		if next < len(methods) && c.Method == methods[next] {
+			next++
+		}
+	}
+	if next < len(methods) {
+		got := make([]string, len(calls))
+		for i, c := range calls {
+			got[i] = c.Method
+		}
+		t.Errorf("jsonrpctest: expected calls in order %v, got %v", methods, got)
+		return false
+	}
+	return true
+}
+
+// AssertGolden compares calls received so far with a golden file, which
+// lists them as JSON lines. The file is written instead when the
+// JSONRPCTEST_UPDATE environment variable is set.
+func (s *Server) AssertGolden(t testing.TB, path string) bool {
+	t.Helper()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, c := range s.Calls() {
+		if err := enc.Encode(c); err != nil {
+			t.Fatalf("jsonrpctest: encoding call of %s: %s", c.Method, err)
+		}
+	}
+
+	if os.Getenv(UpdateGoldenEnv) != "" {
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("jsonrpctest: writing golden file: %s", err)
+		}
+		return true
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("jsonrpctest: reading golden file (set %s=1 to create it): %s", UpdateGoldenEnv, err)
+	}
+	if !bytes.Equal(want, buf.Bytes()) {
+		t.Errorf("jsonrpctest: calls differ from %s (set %s=1 to update it)\nwant:\n%s\ngot:\n%s", path, UpdateGoldenEnv, want, buf.Bytes())
+		return false
+	}
+	return true
+}
+
+func paramsMatch(expected, params []json.RawMessage) bool {
+	if len(expected) != len(params) {
+		return false
+	}
+	for i, e := range expected {
+		if e == nil { // Any
+			continue
+		}
+		if !jsonEqual(e, params[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func jsonEqual(a, b []byte) bool {
+	var av, bv interface{}
+	if err := decodeNumbers(a, &av); err != nil {
+		return false
+	}
+	if err := decodeNumbers(b, &bv); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+func decodeNumbers(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func joinParams(params []json.RawMessage) string {
+	s := make([]string, len(params))
+	for i, p := range params {
+		if p == nil {
+			s[i] = "Any"
+		} else {
+			s[i] = string(p)
+		}
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,192 @@
+package jsonrpctest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitee.com/huanghua_2017/hggutils/jsonrpc"
+)
+
+type User struct {
+	Name string
+	Age  int
+}
+
+type UsersClient struct {
+	Add   func(ctx context.Context, a, b int) (int, error)
+	Get   func(ctx context.Context, name string) (User, error)
+	Watch func(ctx context.Context, name string) (<-chan User, error)
+}
+
+func TestServer(t *testing.T) {
+	srv := NewServer(t)
+	srv.Expect("Users.Add", 1, 2).Return(3)
+	srv.Expect("Users.Add", Any, 5).Return(10).Times(2)
+	srv.Expect("Users.Get", "bob").Return(User{Name: "bob", Age: 30})
+	srv.Expect("Users.Get", "eve").ReturnError(errors.New("no such user"))
+	srv.ExpectStream("Users.Watch", "bob").Stream(User{Name: "bob", Age: 31}, User{Name: "bob", Age: 32})
+
+	for _, addr := range []string{srv.WSURL, srv.URL} {
+		var client UsersClient
+		closer, err := jsonrpc.NewClient(context.Background(), addr, "Users", &client, nil)
+		require.NoError(t, err)
+
+		n, err := client.Add(context.Background(), 1, 2)
+		require.NoError(t, err)
+		require.Equal(t, 3, n)
+
+		n, err = client.Add(context.Background(), 7, 5)
+		require.NoError(t, err)
+		require.Equal(t, 10, n)
+
+		u, err := client.Get(context.Background(), "bob")
+		require.NoError(t, err)
+		require.Equal(t, User{Name: "bob", Age: 30}, u)
+
+		_, err = client.Get(context.Background(), "eve")
+		require.EqualError(t, err, "no such user")
+
+		ch, err := client.Watch(context.Background(), "bob")
+		require.NoError(t, err)
+		var ages []int
+		for u := range ch {
+			ages = append(ages, u.Age)
+		}
+		require.Equal(t, []int{31, 32}, ages)
+
+		closer()
+
+		if addr == srv.WSURL {
+			// the HTTP client makes the same calls
+			srv.Expect("Users.Add", 1, 2).Return(3)
+			srv.Expect("Users.Get", "bob").Return(User{Name: "bob", Age: 30})
+			srv.Expect("Users.Get", "eve").ReturnError(errors.New("no such user"))
+			srv.ExpectStream("Users.Watch", "bob").Stream(User{Name: "bob", Age: 31}, User{Name: "bob", Age: 32})
+		}
+	}
+
+	srv.AssertExpectations(t)
+	srv.AssertCalled(t, "Users.Add", 4)
+	srv.AssertCallOrder(t, "Users.Add", "Users.Get", "Users.Watch", "Users.Add")
+
+	dir, err := ioutil.TempDir("", "jsonrpctest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint
+
+	golden := filepath.Join(dir, "calls.golden")
+	require.NoError(t, os.Setenv(UpdateGoldenEnv, "1"))
+	srv.AssertGolden(t, golden)
+	require.NoError(t, os.Unsetenv(UpdateGoldenEnv))
+	srv.AssertGolden(t, golden)
+
+	data, err := ioutil.ReadFile(golden)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `{"method":"Users.Add","params":[1,2]}`)
+}
+
+// recordingT captures test failures, for checking them
+type recordingT struct {
+	*testing.T
+
+	lk   sync.Mutex
+	errs []string
+}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.errs = append(t.errs, fmt.Sprintf(format, args...))
+}
+
+func (t *recordingT) failures() []string {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return t.errs
+}
+
+func TestServerUnexpected(t *testing.T) {
+	rt := &recordingT{T: t}
+
+	srv := NewServer(rt)
+	srv.Expect("Users.Add", 1, 2).Return(3)
+	srv.Expect("Users.Get", "bob").Return(User{Name: "bob"})
+
+	var client UsersClient
+	closer, err := jsonrpc.NewClient(context.Background(), srv.WSURL, "Users", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	_, err = client.Add(context.Background(), 2, 2)
+	require.Error(t, err)
+	require.Equal(t, []string{"jsonrpctest: unexpected call Users.Add(2, 2)"}, rt.failures())
+
+	require.False(t, srv.AssertExpectations(rt))
+	require.False(t, srv.AssertCallOrder(rt, "Users.Get"))
+	require.Len(t, rt.failures(), 4)
+
+	calls := srv.Calls()
+	require.Len(t, calls, 1)
+	require.True(t, calls[0].Unexpected)
+}
+
+func TestFaults(t *testing.T) {
+	srv := NewServer(t)
+	srv.Expect("Users.Add", Any, Any).Return(3).Times(0)
+
+	var client UsersClient
+	closer, err := jsonrpc.NewMergeClient(context.Background(), srv.WSURL, "Users", []interface{}{&client}, nil, srv.Faults.ClientOption())
+	require.NoError(t, err)
+	defer closer()
+
+	// delayed responses
+	srv.Faults.Delay(50 * time.Millisecond)
+	start := time.Now()
+	_, err = client.Add(context.Background(), 1, 2)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+	srv.Faults.Delay(0)
+
+	// the corrupted response never arrives, the connection keeps working
+	srv.Faults.CorruptFrames(1)
+	lost := make(chan struct{})
+	go func() {
+		_, _ = client.Add(context.Background(), 1, 2)
+		close(lost)
+	}()
+	require.Eventually(t, func() bool {
+		srv.Faults.lk.Lock()
+		defer srv.Faults.lk.Unlock()
+		return srv.Faults.corrupt == 0
+	}, time.Second, 10*time.Millisecond)
+
+	n, err := client.Add(context.Background(), 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	select {
+	case <-lost:
+		t.Fatal("corrupted response was received")
+	default:
+	}
+
+	// the client reconnects after failed dials
+	srv.Faults.FailDials(2)
+	srv.Faults.DropConnections()
+	require.Eventually(t, func() bool {
+		_, err := client.Add(context.Background(), 1, 2)
+		return err == nil
+	}, 10*time.Second, 50*time.Millisecond)
+
+	srv.Faults.lk.Lock()
+	require.Zero(t, srv.Faults.failDials)
+	srv.Faults.lk.Unlock()
+}
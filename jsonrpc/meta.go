@@ -0,0 +1,112 @@
+package jsonrpc
+
+import (
+	"context"
+	"sync"
+)
+
+// Meta is a set of key/value pairs sent along with requests and responses,
+// next to call params / results. It can carry things like request IDs,
+// tenant IDs or locale without changing method signatures.
+//
+// Keys used internally by the library (e.g. traceparent) may be overwritten.
+type Meta map[string]string
+
+type outMetaKey struct{}
+type reqMetaKey struct{}
+type respMetaKey struct{}
+type respMetaSinkKey struct{}
+
+// WithMeta returns a context which makes clients send the key/value pair as
+// request metadata on calls made with it. Values set by parent contexts are
+// kept unless overwritten.
+func WithMeta(ctx context.Context, key, value string) context.Context {
+	parent, _ := ctx.Value(outMetaKey{}).(Meta)
+
+	m := make(Meta, len(parent)+1)
+	for k, v := range parent {
+		m[k] = v
+	}
+	m[key] = value
+
+	return context.WithValue(ctx, outMetaKey{}, m)
+}
+
+// RequestMeta returns metadata of the request being handled. It's only
+// available in contexts passed to RPC handlers. The returned map must not be
+// modified.
+func RequestMeta(ctx context.Context) Meta {
+	m, _ := ctx.Value(reqMetaKey{}).(Meta)
+	return m
+}
+
+// SetResponseMeta sets a key/value pair which will be sent back to the client
+// with the response. It's only available in contexts passed to RPC handlers,
+// false is returned otherwise.
+func SetResponseMeta(ctx context.Context, key, value string) bool {
+	rm, ok := ctx.Value(respMetaKey{}).(*respMeta)
+	if !ok {
+		return false
+	}
+
+	rm.lk.Lock()
+	defer rm.lk.Unlock()
+
+	if rm.m == nil {
+		rm.m = Meta{}
+	}
+	rm.m[key] = value
+	return true
+}
+
+// WithResponseMeta returns a context which makes clients store response
+// metadata of calls made with it in the given map.
+func WithResponseMeta(ctx context.Context, out Meta) context.Context {
+	return context.WithValue(ctx, respMetaSinkKey{}, out)
+}
+
+// respMeta collects response metadata set by a handler
+type respMeta struct {
+	lk sync.Mutex
+	m  Meta
+}
+
+func (rm *respMeta) get() Meta {
+	rm.lk.Lock()
+	defer rm.lk.Unlock()
+
+	return rm.m
+}
+
+// withHandlerMeta prepares the context for a handler call
+func withHandlerMeta(ctx context.Context, meta map[string]string) (context.Context, *respMeta) {
+	rm := &respMeta{}
+
+	ctx = context.WithValue(ctx, reqMetaKey{}, Meta(meta))
+	ctx = context.WithValue(ctx, respMetaKey{}, rm)
+	return ctx, rm
+}
+
+// outgoingMeta returns a copy of metadata attached with WithMeta
+func outgoingMeta(ctx context.Context) map[string]string {
+	m, _ := ctx.Value(outMetaKey{}).(Meta)
+
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// deliverResponseMeta copies response metadata to the sink set with
+// WithResponseMeta
+func deliverResponseMeta(ctx context.Context, meta map[string]string) {
+	out, ok := ctx.Value(respMetaSinkKey{}).(Meta)
+	if !ok || out == nil {
+		return
+	}
+
+	for k, v := range meta {
+		out[k] = v
+	}
+}
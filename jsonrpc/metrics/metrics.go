@@ -6,6 +6,12 @@ import (
 	"go.opencensus.io/tag"
 )
 
+// Distributions
+var (
+	defaultMillisecondsDistribution = view.Distribution(0.1, 0.5, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000)
+	defaultBytesDistribution        = view.Distribution(64, 256, 1<<10, 4<<10, 16<<10, 64<<10, 256<<10, 1<<20, 4<<20, 16<<20, 64<<20)
+)
+
 // Global Tags
 var (
 	RPCMethod, _ = tag.NewKey("method")
@@ -16,6 +22,21 @@ var (
 	RPCInvalidMethod = stats.Int64("rpc/invalid_method", "Total number of invalid RPC methods called", stats.UnitDimensionless)
 	RPCRequestError  = stats.Int64("rpc/request_error", "Total number of request errors handled", stats.UnitDimensionless)
 	RPCResponseError = stats.Int64("rpc/response_error", "Total number of responses errors handled", stats.UnitDimensionless)
+
+	RPCRequests         = stats.Int64("rpc/requests", "Total number of RPC requests handled", stats.UnitDimensionless)
+	RPCRequestDuration  = stats.Float64("rpc/request_duration_ms", "Duration of RPC requests in milliseconds", stats.UnitMilliseconds)
+	RPCRequestsInFlight = stats.Int64("rpc/requests_in_flight", "Number of RPC requests currently being handled", stats.UnitDimensionless)
+	RPCRequestSize      = stats.Int64("rpc/request_size", "Size of RPC requests in bytes", stats.UnitBytes)
+	RPCResponseSize     = stats.Int64("rpc/response_size", "Size of RPC responses in bytes", stats.UnitBytes)
+
+	RPCWebsocketConnections = stats.Int64("rpc/ws_connections", "Number of active server websocket connections", stats.UnitDimensionless)
+	RPCStreamConnections    = stats.Int64("rpc/stream_connections", "Number of active server HTTP/2 stream connections", stats.UnitDimensionless)
+	RPCChannels             = stats.Int64("rpc/channels", "Number of active channel subscriptions", stats.UnitDimensionless)
+	RPCClientReconnects     = stats.Int64("rpc/client_reconnects", "Total number of websocket client reconnects", stats.UnitDimensionless)
+	RPCWebsocketRTT         = stats.Float64("rpc/ws_rtt_ms", "Websocket keepalive round-trip time", stats.UnitMilliseconds)
+
+	RPCCacheHits   = stats.Int64("rpc/cache_hits", "Total number of calls answered from the response cache or by an identical call", stats.UnitDimensionless)
+	RPCCacheMisses = stats.Int64("rpc/cache_misses", "Total number of calls of cached methods which were executed", stats.UnitDimensionless)
 )
 
 var (
@@ -35,6 +56,64 @@ var (
 		Aggregation: view.Count(),
 		TagKeys:     []tag.Key{RPCMethod},
 	}
+	RPCRequestsView = &view.View{
+		Measure:     RPCRequests,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{RPCMethod},
+	}
+	RPCRequestDurationView = &view.View{
+		Measure:     RPCRequestDuration,
+		Aggregation: defaultMillisecondsDistribution,
+		TagKeys:     []tag.Key{RPCMethod},
+	}
+	// in-flight requests are recorded as +1/-1, so the sum is the current value
+	RPCRequestsInFlightView = &view.View{
+		Measure:     RPCRequestsInFlight,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{RPCMethod},
+	}
+	RPCRequestSizeView = &view.View{
+		Measure:     RPCRequestSize,
+		Aggregation: defaultBytesDistribution,
+		TagKeys:     []tag.Key{RPCMethod},
+	}
+	RPCResponseSizeView = &view.View{
+		Measure:     RPCResponseSize,
+		Aggregation: defaultBytesDistribution,
+		TagKeys:     []tag.Key{RPCMethod},
+	}
+
+	// Connection level metrics aren't tied to a method
+	RPCWebsocketConnectionsView = &view.View{
+		Measure:     RPCWebsocketConnections,
+		Aggregation: view.Sum(),
+	}
+	RPCStreamConnectionsView = &view.View{
+		Measure:     RPCStreamConnections,
+		Aggregation: view.Sum(),
+	}
+	RPCChannelsView = &view.View{
+		Measure:     RPCChannels,
+		Aggregation: view.Sum(),
+	}
+	RPCClientReconnectsView = &view.View{
+		Measure:     RPCClientReconnects,
+		Aggregation: view.Count(),
+	}
+	RPCWebsocketRTTView = &view.View{
+		Measure:     RPCWebsocketRTT,
+		Aggregation: defaultMillisecondsDistribution,
+	}
+	RPCCacheHitsView = &view.View{
+		Measure:     RPCCacheHits,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{RPCMethod},
+	}
+	RPCCacheMissesView = &view.View{
+		Measure:     RPCCacheMisses,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{RPCMethod},
+	}
 )
 
 // DefaultViews is an array of OpenCensus views for metric gathering purposes
@@ -42,4 +121,16 @@ var DefaultViews = []*view.View{
 	RPCInvalidMethodView,
 	RPCRequestErrorView,
 	RPCResponseErrorView,
+	RPCRequestsView,
+	RPCRequestDurationView,
+	RPCRequestsInFlightView,
+	RPCRequestSizeView,
+	RPCResponseSizeView,
+	RPCWebsocketConnectionsView,
+	RPCStreamConnectionsView,
+	RPCChannelsView,
+	RPCClientReconnectsView,
+	RPCWebsocketRTTView,
+	RPCCacheHitsView,
+	RPCCacheMissesView,
 }
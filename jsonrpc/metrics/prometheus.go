@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.opencensus.io/stats/view"
+)
+
+// PrometheusHandler returns an http.Handler serving the current data of the
+// given views in the Prometheus text exposition format. When no views are
+// given DefaultViews are used. Count views are exported as counters, named
+// with a _total suffix, and sum views as gauges.
+//
+// Views must be registered with view.Register to be collected, unregistered
+// views are skipped.
+func PrometheusHandler(namespace string, views ...*view.View) http.Handler {
+	if len(views) == 0 {
+		views = DefaultViews
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		bw := bufio.NewWriter(w)
+		for _, v := range views {
+			rows, err := view.RetrieveData(viewName(v))
+			if err != nil {
+				continue
+			}
+			writeView(bw, namespace, v, rows)
+		}
+		_ = bw.Flush()
+	})
+}
+
+func viewName(v *view.View) string {
+	if v.Name != "" {
+		return v.Name
+	}
+	return v.Measure.Name()
+}
+
+func metricName(namespace string, v *view.View) string {
+	name := viewName(v)
+	if namespace != "" {
+		name = namespace + "_" + name
+	}
+
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func writeView(w *bufio.Writer, namespace string, v *view.View, rows []*view.Row) {
+	name := metricName(namespace, v)
+
+	desc := v.Description
+	if desc == "" {
+		desc = v.Measure.Description()
+	}
+
+	var typ string
+	switch v.Aggregation.Type {
+	case view.AggTypeCount:
+		typ = "counter"
+		if !strings.HasSuffix(name, "_total") {
+			name += "_total"
+		}
+	case view.AggTypeLastValue, view.AggTypeSum:
+		// sums of the views here go up and down, like requests in flight
+		typ = "gauge"
+	case view.AggTypeDistribution:
+		typ = "histogram"
+	default:
+		typ = "untyped"
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, escapeHelp(desc))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].String() < rows[j].String()
+	})
+
+	for _, row := range rows {
+		labels := make([]string, 0, len(row.Tags))
+		for _, t := range row.Tags {
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, t.Key.Name(), escapeLabel(t.Value)))
+		}
+
+		switch data := row.Data.(type) {
+		case *view.CountData:
+			fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(labels), data.Value)
+		case *view.SumData:
+			fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels), formatFloat(data.Value))
+		case *view.LastValueData:
+			fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels), formatFloat(data.Value))
+		case *view.DistributionData:
+			var cumulative int64
+			for i, bound := range v.Aggregation.Buckets {
+				if i < len(data.CountPerBucket) {
+					cumulative += data.CountPerBucket[i]
+				}
+				le := fmt.Sprintf(`le="%s"`, formatFloat(bound))
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(append(labels, le)), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(append(labels, `le="+Inf"`)), data.Count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(labels), formatFloat(data.Mean*float64(data.Count)))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(labels), data.Count)
+		}
+	}
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+func escapeLabel(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
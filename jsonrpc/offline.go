@@ -0,0 +1,198 @@
+package jsonrpc
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrOfflineQueueFull is returned for calls which can't be queued because the
+// offline queue is full
+var ErrOfflineQueueFull = xerrors.New("offline request queue is full")
+
+// OfflinePolicy controls what websocket clients do with calls while the
+// connection is down. It can be set for all methods with WithOfflinePolicy,
+// or per method with an `offline:"wait|failfast|queue|replay"` struct tag.
+type OfflinePolicy int
+
+const (
+	// OfflineWait blocks calls until the connection is back
+	OfflineWait OfflinePolicy = iota
+	// OfflineFailFast returns ErrDisconnected right away
+	OfflineFailFast
+	// OfflineQueue holds calls in the offline queue, they are sent in order
+	// once the client reconnects. Calls are dropped from the queue when their
+	// context is done.
+	OfflineQueue
+	// OfflineReplay queues calls like OfflineQueue, and additionally puts calls
+	// which were in-flight when the connection was lost back into the queue,
+	// instead of failing them. Only use it for idempotent methods.
+	OfflineReplay
+)
+
+func parseOfflinePolicy(s string) (OfflinePolicy, error) {
+	switch s {
+	case "wait":
+		return OfflineWait, nil
+	case "failfast":
+		return OfflineFailFast, nil
+	case "queue":
+		return OfflineQueue, nil
+	case "replay":
+		return OfflineReplay, nil
+	default:
+		return 0, xerrors.Errorf("unknown offline policy '%s'", s)
+	}
+}
+
+// offlineQueue holds client requests made while the websocket connection is
+// down, and flushes them in order once it's back up
+type offlineQueue struct {
+	lk    sync.Mutex
+	max   int
+	items *list.List // of clientRequest
+
+	wake chan struct{}
+}
+
+func newOfflineQueue(max int) *offlineQueue {
+	return &offlineQueue{
+		max:   max,
+		items: list.New(),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+func (q *offlineQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// push adds a request at the end of the queue
+func (q *offlineQueue) push(cr clientRequest) error {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	if q.items.Len() >= q.max {
+		return ErrOfflineQueueFull
+	}
+	q.items.PushBack(cr)
+	q.notify()
+	return nil
+}
+
+// requeue puts requests which were in-flight on a lost connection in front of
+// the queue, ordered by ID. Requests which don't fit are returned.
+func (q *offlineQueue) requeue(crs []clientRequest) []clientRequest {
+	sort.Slice(crs, func(i, j int) bool {
+		return *crs[i].req.ID < *crs[j].req.ID
+	})
+
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	front := q.items.Front()
+	for i, cr := range crs {
+		if q.items.Len() >= q.max {
+			return crs[i:]
+		}
+		if front == nil {
+			q.items.PushBack(cr)
+		} else {
+			q.items.InsertBefore(cr, front)
+		}
+	}
+	q.notify()
+	return nil
+}
+
+// remove drops a request from the queue, false is returned if it was already
+// sent
+func (q *offlineQueue) remove(id int64) bool {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	for e := q.items.Front(); e != nil; e = e.Next() {
+		if *e.Value.(clientRequest).req.ID == id {
+			q.items.Remove(e)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *offlineQueue) len() int {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	return q.items.Len()
+}
+
+func (q *offlineQueue) pop() (clientRequest, bool) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	e := q.items.Front()
+	if e == nil {
+		return clientRequest{}, false
+	}
+	q.items.Remove(e)
+	return e.Value.(clientRequest), true
+}
+
+// run sends queued requests whenever the connection is up. When the client
+// exits, requests left in the queue are failed.
+func (q *offlineQueue) run(status *ConnStatus, requests chan<- clientRequest, exiting <-chan struct{}) {
+	status.OnChange(func(change ConnStateChange) {
+		if change.State == StateConnected {
+			q.notify()
+		}
+	})
+
+	for {
+		select {
+		case <-q.wake:
+			q.flush(status, requests, exiting)
+		case <-exiting:
+			for {
+				cr, ok := q.pop()
+				if !ok {
+					return
+				}
+				failOffline(cr)
+			}
+		}
+	}
+}
+
+func (q *offlineQueue) flush(status *ConnStatus, requests chan<- clientRequest, exiting <-chan struct{}) {
+	for status.State() == StateConnected {
+		cr, ok := q.pop()
+		if !ok {
+			return
+		}
+		select {
+		case requests <- cr:
+		case <-exiting:
+			for _, cr := range q.requeue([]clientRequest{cr}) {
+				failOffline(cr)
+			}
+			return
+		}
+	}
+}
+
+func failOffline(cr clientRequest) {
+	cr.ready <- clientResponse{
+		Jsonrpc: "2.0",
+		ID:      *cr.req.ID,
+		Error: &respError{
+			Message: "handler: websocket connection closed",
+			Code:    2,
+		},
+	}
+}
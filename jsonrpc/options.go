@@ -1,6 +1,7 @@
 package jsonrpc
 
 import (
+	"net/http"
 	"reflect"
 	"time"
 
@@ -13,11 +14,32 @@ type Config struct {
 	reconnectBackoff backoff
 	pingInterval     time.Duration
 	timeout          time.Duration
+	nativePing       bool
+	chunkSize        int
+	maxMessageSize   int64
 
-	paramEncoders map[reflect.Type]ParamEncoder
+	paramEncoders  map[reflect.Type]ParamEncoder
+	resultDecoders map[reflect.Type]ResultDecoder
+	decodeFlags    DecodeFlags
+
+	balancePolicy   BalancePolicy
+	resolver        Resolver
+	endpointBackoff backoff
+
+	retryPolicy *RetryPolicy
+
+	maxReconnectAttempts int
+	connStatus           *ConnStatus
+
+	offlinePolicy    OfflinePolicy
+	offlineQueueSize int
+
+	longPoll   bool
+	httpStream bool
+	httpClient *http.Client
 
 	noReconnect      bool
-	proxyConnFactory func(func() (*websocket.Conn, error)) func() (*websocket.Conn, error) // for testing
+	proxyConnFactory func(func() (*websocket.Conn, error)) func() (*websocket.Conn, error) // for testing, see WithConnFactory
 }
 
 func defaultConfig() Config {
@@ -28,8 +50,20 @@ func defaultConfig() Config {
 		},
 		pingInterval: 30 * time.Second,
 		timeout:      30 * time.Second,
+		httpClient:   _defaultHTTPClient,
+
+		chunkSize:      DEFAULT_CHUNK_SIZE,
+		maxMessageSize: DEFAULT_MAX_REQUEST_SIZE,
 
-		paramEncoders: map[reflect.Type]ParamEncoder{},
+		paramEncoders:  map[reflect.Type]ParamEncoder{},
+		resultDecoders: map[reflect.Type]ResultDecoder{},
+
+		endpointBackoff: backoff{
+			minDelay: time.Second,
+			maxDelay: time.Minute,
+		},
+
+		offlineQueueSize: 64,
 	}
 }
 
@@ -51,6 +85,61 @@ func WithPingInterval(d time.Duration) func(c *Config) {
 	}
 }
 
+// WithNativePing makes websocket clients send keepalive pings as websocket
+// ping control frames, instead of xrpc.ping messages. Any websocket server
+// answers them, and pongs are handled below the JSON-RPC layer.
+func WithNativePing() func(c *Config) {
+	return func(c *Config) {
+		c.nativePing = true
+	}
+}
+
+// WithLongPoll makes HTTP clients call channel-returning methods with
+// long-polling, instead of server-sent events. Useful behind proxies which
+// buffer responses.
+func WithLongPoll() func(c *Config) {
+	return func(c *Config) {
+		c.longPoll = true
+	}
+}
+
+// WithHTTPStream makes clients of http(s) endpoints keep a full-duplex HTTP/2
+// stream to the server, which works like a websocket connection: channels,
+// cancellation and reverse calls are supported, and the stream is re-opened
+// when it's lost. Useful behind load balancers which don't support websockets.
+// The server must be reached over HTTP/2, e.g. with TLS.
+func WithHTTPStream() func(c *Config) {
+	return func(c *Config) {
+		c.httpStream = true
+	}
+}
+
+// WithHTTPClient sets the client used for HTTP requests and streams, e.g. to
+// configure TLS
+func WithHTTPClient(hc *http.Client) func(c *Config) {
+	return func(c *Config) {
+		c.httpClient = hc
+	}
+}
+
+// WithChunkSize sets the size of chunks large requests are split into on
+// websocket connections, if the server accepts chunked messages. Zero disables
+// chunking.
+func WithChunkSize(size int) func(c *Config) {
+	return func(c *Config) {
+		c.chunkSize = size
+	}
+}
+
+// WithMaxMessageSize limits the size of messages received over websocket,
+// including reassembled chunked messages. Chunked messages of concurrent calls
+// being reassembled at once can buffer up to 8 times the limit together.
+func WithMaxMessageSize(max int64) func(c *Config) {
+	return func(c *Config) {
+		c.maxMessageSize = max
+	}
+}
+
 func WithTimeout(d time.Duration) func(c *Config) {
 	return func(c *Config) {
 		c.timeout = d
@@ -68,3 +157,102 @@ func WithParamEncoder(t interface{}, encoder ParamEncoder) func(c *Config) {
 		c.paramEncoders[reflect.TypeOf(t).Elem()] = encoder
 	}
 }
+
+// WithResultDecoder decodes results of the type of t (which must be a
+// pointer) with the decoder, including values received on channels
+func WithResultDecoder(t interface{}, decoder ResultDecoder) func(c *Config) {
+	return func(c *Config) {
+		c.resultDecoders[reflect.TypeOf(t).Elem()] = decoder
+	}
+}
+
+// WithResultDecoding makes decoding of responses and results stricter, e.g.
+// WithResultDecoding(StrictDecoding) rejects results with unknown fields
+func WithResultDecoding(flags DecodeFlags) func(c *Config) {
+	return func(c *Config) {
+		c.decodeFlags = flags
+	}
+}
+
+// WithBalancePolicy sets how clients with multiple endpoints pick one
+func WithBalancePolicy(p BalancePolicy) func(c *Config) {
+	return func(c *Config) {
+		c.balancePolicy = p
+	}
+}
+
+// WithResolver sets a function providing endpoints in addition to addresses
+// given to the client constructor
+func WithResolver(r Resolver) func(c *Config) {
+	return func(c *Config) {
+		c.resolver = r
+	}
+}
+
+// WithEndpointBackoff sets for how long failed endpoints are avoided, the
+// delay grows with consecutive failures
+func WithEndpointBackoff(minDelay, maxDelay time.Duration) func(c *Config) {
+	return func(c *Config) {
+		c.endpointBackoff = backoff{
+			minDelay: minDelay,
+			maxDelay: maxDelay,
+		}
+	}
+}
+
+// WithRetryPolicy enables automatic retries of failed calls
+func WithRetryPolicy(p RetryPolicy) func(c *Config) {
+	return func(c *Config) {
+		c.retryPolicy = &p
+	}
+}
+
+// WithReconnectMaxAttempts limits reconnect attempts of websocket clients,
+// the client is closed when they run out. Zero means no limit.
+func WithReconnectMaxAttempts(n int) func(c *Config) {
+	return func(c *Config) {
+		c.maxReconnectAttempts = n
+	}
+}
+
+// WithConnStatus makes websocket clients report connection state changes to s
+func WithConnStatus(s *ConnStatus) func(c *Config) {
+	return func(c *Config) {
+		c.connStatus = s
+	}
+}
+
+// WithFailFast makes websocket clients return ErrDisconnected for calls made
+// while the connection is down, instead of waiting for a reconnect
+func WithFailFast() func(c *Config) {
+	return func(c *Config) {
+		c.offlinePolicy = OfflineFailFast
+	}
+}
+
+// WithOfflinePolicy sets what websocket clients do with calls made while the
+// connection is down, for methods without an `offline` struct tag
+func WithOfflinePolicy(p OfflinePolicy) func(c *Config) {
+	return func(c *Config) {
+		c.offlinePolicy = p
+	}
+}
+
+// WithOfflineQueue queues calls made while the websocket connection is down,
+// up to size calls, and sends them in order once reconnected. Calls made when
+// the queue is full fail with ErrOfflineQueueFull.
+func WithOfflineQueue(size int) func(c *Config) {
+	return func(c *Config) {
+		c.offlineQueueSize = size
+		c.offlinePolicy = OfflineQueue
+	}
+}
+
+// WithConnFactory wraps the function dialing websocket connections, which is
+// called for the first connection and on each reconnect. It's meant for
+// tests, e.g. to make dials fail, see the jsonrpctest package.
+func WithConnFactory(proxy func(dial func() (*websocket.Conn, error)) func() (*websocket.Conn, error)) func(c *Config) {
+	return func(c *Config) {
+		c.proxyConnFactory = proxy
+	}
+}
@@ -2,14 +2,40 @@ package jsonrpc
 
 import (
 	"context"
+	"io"
 	"reflect"
+	"time"
 )
 
 type ParamDecoder func(ctx context.Context, json []byte) (reflect.Value, error)
 
 type ServerConfig struct {
 	paramDecoders  map[reflect.Type]ParamDecoder
+	decodeFlags    DecodeFlags
+	validateParams bool
+	resultEncoders map[reflect.Type]ResultEncoder
 	maxRequestSize int64
+	chunkSize      int
+
+	defaultTimeout time.Duration
+	maxTimeout     time.Duration
+	methodTimeouts map[string]methodTimeout
+	readOnly       map[string]string
+	methodCaches   map[string]CacheConfig
+
+	dedupWindow    time.Duration
+	dedupPrincipal func(ctx context.Context) string
+
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+
+	subscribeAuth SubscribeAuthFunc
+
+	panicHandler    PanicHandler
+	hidePanicDetail bool
+	crashOnPanic    bool
+
+	recorder *recorder
 }
 
 type ServerOption func(c *ServerConfig)
@@ -17,7 +43,12 @@ type ServerOption func(c *ServerConfig)
 func defaultServerConfig() ServerConfig {
 	return ServerConfig{
 		paramDecoders:  map[reflect.Type]ParamDecoder{},
+		resultEncoders: map[reflect.Type]ResultEncoder{},
 		maxRequestSize: DEFAULT_MAX_REQUEST_SIZE,
+		chunkSize:      DEFAULT_CHUNK_SIZE,
+		methodTimeouts: map[string]methodTimeout{},
+		readOnly:       map[string]string{},
+		methodCaches:   map[string]CacheConfig{},
 	}
 }
 
@@ -27,8 +58,170 @@ func WithParamDecoder(t interface{}, decoder ParamDecoder) ServerOption {
 	}
 }
 
+// WithParamDecoding makes decoding of requests and params stricter, e.g.
+// WithParamDecoding(StrictDecoding) rejects params with unknown fields and
+// requests with trailing data
+func WithParamDecoding(flags DecodeFlags) ServerOption {
+	return func(c *ServerConfig) {
+		c.decodeFlags = flags
+	}
+}
+
+// WithResultEncoder converts results of the type of t (which must be a
+// pointer) before they are sent, including values sent on channels
+func WithResultEncoder(t interface{}, encoder ResultEncoder) ServerOption {
+	return func(c *ServerConfig) {
+		c.resultEncoders[reflect.TypeOf(t).Elem()] = encoder
+	}
+}
+
+// WithParamValidation makes the server check decoded params before calling
+// methods. Param types implementing Validator are checked with their Validate
+// method, struct fields with `validate` tags (see checkTag for rules) are
+// checked too, including in nested structs and slices. Calls with invalid
+// params fail with the -32602 Invalid params error, listing the invalid
+// fields in the error data, see FieldErrors.
+func WithParamValidation() ServerOption {
+	return func(c *ServerConfig) {
+		c.validateParams = true
+	}
+}
+
+// WithMaxRequestSize limits the size of HTTP request bodies and of messages
+// received over websocket, including reassembled chunked messages. Chunked
+// messages of concurrent calls being reassembled at once can buffer up to 8
+// times the limit together.
 func WithMaxRequestSize(max int64) ServerOption {
 	return func(c *ServerConfig) {
 		c.maxRequestSize = max
 	}
 }
+
+// WithServerChunkSize sets the size of chunks large responses are split into
+// on websocket connections, for clients which accept chunked messages. Zero
+// disables chunking.
+func WithServerChunkSize(size int) ServerOption {
+	return func(c *ServerConfig) {
+		c.chunkSize = size
+	}
+}
+
+// WithDefaultTimeout sets the timeout applied to calls which don't carry a
+// deadline from the client. Zero means no timeout.
+func WithDefaultTimeout(d time.Duration) ServerOption {
+	return func(c *ServerConfig) {
+		c.defaultTimeout = d
+	}
+}
+
+// WithMaxTimeout caps the time any call is allowed to run, including calls
+// with a longer deadline set by the client. Zero means no limit.
+func WithMaxTimeout(d time.Duration) ServerOption {
+	return func(c *ServerConfig) {
+		c.maxTimeout = d
+	}
+}
+
+// WithMethodTimeout overrides the default and max timeouts for a single
+// method (full name, e.g. "Namespace.Method"). Zero values fall back to
+// server-wide settings, negative values disable the timeout for the method.
+func WithMethodTimeout(method string, def, max time.Duration) ServerOption {
+	return func(c *ServerConfig) {
+		c.methodTimeouts[method] = methodTimeout{def: def, max: max}
+	}
+}
+
+// WithReadOnly marks a method (full name, e.g. "Namespace.Method") as
+// read-only, making it callable with GET requests like
+// /rpc?method=Namespace.Method&params=[1,"a"], params can also be base64url
+// encoded. Successful responses carry an ETag and the given Cache-Control
+// value ("no-cache" when empty), so browsers and CDNs can cache them.
+func WithReadOnly(method string, cacheControl string) ServerOption {
+	return func(c *ServerConfig) {
+		c.readOnly[method] = cacheControl
+	}
+}
+
+// WithMethodCache caches responses of a method (full name, e.g.
+// "Namespace.Method") as set in config. Cached responses are dropped with
+// InvalidateCache and InvalidateCachePrefix. Calls returning channels aren't
+// cached.
+func WithMethodCache(method string, config CacheConfig) ServerOption {
+	return func(c *ServerConfig) {
+		c.methodCaches[method] = config
+	}
+}
+
+// WithDeduplication makes the server execute calls carrying the same
+// idempotency key (sent by clients with a RetryPolicy) at most once within
+// the window; retries get the response of the first call. Keys are shared by
+// all callers unless WithDeduplicationPrincipal is set.
+func WithDeduplication(window time.Duration) ServerOption {
+	return func(c *ServerConfig) {
+		c.dedupWindow = window
+	}
+}
+
+// WithDeduplicationPrincipal scopes idempotency keys to who makes calls, e.g.
+// from values set in the context by an authentication middleware, so that
+// callers can't get responses of calls made by others.
+func WithDeduplicationPrincipal(principal func(ctx context.Context) string) ServerOption {
+	return func(c *ServerConfig) {
+		c.dedupPrincipal = principal
+	}
+}
+
+// WithKeepalive makes the server ping websocket clients every interval, using
+// ping control frames, and close connections on which nothing was received
+// for timeout. This detects half-open connections, timeout should be a few
+// times the interval. Zero interval disables keepalive, which is the default.
+func WithKeepalive(interval, timeout time.Duration) ServerOption {
+	return func(c *ServerConfig) {
+		c.keepaliveInterval = interval
+		c.keepaliveTimeout = timeout
+	}
+}
+
+// WithSubscribeAuth sets a check run for every pub/sub subscription, with the
+// requested topic pattern. Subscriptions are rejected with the returned error.
+func WithSubscribeAuth(check SubscribeAuthFunc) ServerOption {
+	return func(c *ServerConfig) {
+		c.subscribeAuth = check
+	}
+}
+
+// WithPanicHandler sets a function called with panics recovered from RPC
+// methods, and from sending values of channels they return. Calls which
+// panicked fail with an error for which IsPanic is true.
+func WithPanicHandler(h PanicHandler) ServerOption {
+	return func(c *ServerConfig) {
+		c.panicHandler = h
+	}
+}
+
+// WithPanicDetail sets whether errors of calls which panicked include the
+// panic value, which is the default. Values may contain internal details not
+// meant for clients.
+func WithPanicDetail(include bool) ServerOption {
+	return func(c *ServerConfig) {
+		c.hidePanicDetail = !include
+	}
+}
+
+// WithCrashOnPanic makes panics in RPC methods crash the process after they
+// are logged and passed to the panic handler, which is useful in development
+func WithCrashOnPanic() ServerOption {
+	return func(c *ServerConfig) {
+		c.crashOnPanic = true
+	}
+}
+
+// WithRecording writes calls selected by the config to w as JSON lines,
+// with their meta, params, response and timing. Recorded calls can be
+// replayed with Replay or ReplayHTTP. Calls returning channels are only
+// recorded when they fail.
+func WithRecording(w io.Writer, config RecordConfig) ServerOption {
+	return func(c *ServerConfig) {
+		c.recorder = newRecorder(w, config)
+	}
+}
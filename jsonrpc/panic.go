@@ -0,0 +1,99 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/xerrors"
+)
+
+// PanicError describes a panic recovered in an RPC method, or while sending
+// values of a channel returned by one
+type PanicError struct {
+	Method string
+	Value  interface{}
+	Stack  []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in rpc method '%s': %v", e.Method, e.Value)
+}
+
+// PanicHandler is called with each recovered panic, e.g. to report it to an
+// error tracker, see WithPanicHandler
+type PanicHandler func(ctx context.Context, p *PanicError)
+
+// IsPanic reports whether a call failed because the method panicked on the
+// server
+func IsPanic(err error) bool {
+	var rerr *respError
+	return xerrors.As(err, &rerr) && rerr.Code == rpcPanic
+}
+
+// protect calls f, recovering panics. Recovered panics are logged and passed
+// to the panic handler, then returned as a *PanicError, unless the server
+// was set up to crash on panics.
+func (s *RPCServer) protect(ctx context.Context, method string, f func()) (err error) {
+	defer func() {
+		i := recover()
+		if i == nil {
+			return
+		}
+
+		perr := &PanicError{
+			Method: method,
+			Value:  i,
+			Stack:  debug.Stack(),
+		}
+		log.Desugar().WithOptions(zap.AddStacktrace(zapcore.ErrorLevel)).Sugar().Error(perr)
+
+		if s.panicHandler != nil {
+			s.panicHandler(ctx, perr)
+		}
+		if s.crashOnPanic {
+			panic(i)
+		}
+		err = perr
+	}()
+
+	f()
+	return nil
+}
+
+// marshalChanValue marshals a message carrying a value of a channel returned
+// by method. Panics in MarshalJSON methods are recovered, so that they only
+// close the channel. Failures are logged, the returned error is the one the
+// channel is closed with on the client.
+func (s *RPCServer) marshalChanValue(ctx context.Context, method string, v interface{}) ([]byte, error) {
+	var msg []byte
+	var err error
+	var perr *PanicError
+	if xerrors.As(s.protect(ctx, method, func() {
+		msg, err = json.Marshal(v)
+	}), &perr) {
+		return nil, s.panicMessage(perr)
+	}
+	if err != nil {
+		log.Errorf("marshaling value of channel returned by '%s': %s", method, err)
+		// values are marshaled by MarshalJSON of params, errors are wrapped
+		// once for each
+		var merr *json.MarshalerError
+		for xerrors.As(err, &merr) {
+			err = merr.Err
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// panicMessage is the error sent to the client for a recovered panic
+func (s *RPCServer) panicMessage(perr *PanicError) error {
+	if s.hidePanicDetail {
+		return xerrors.Errorf("panic in rpc method '%s'", perr.Method)
+	}
+	return perr
+}
@@ -0,0 +1,214 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// subscribeMethod is the built-in method clients call to subscribe to topics,
+// see the `subscribe:"true"` client struct tag
+const subscribeMethod = "xrpc.Subscribe"
+
+// subscriberBuffer is how many events can be queued for a subscriber, slow
+// subscribers which fall further behind are unsubscribed
+const subscriberBuffer = 64
+
+// Event is a value published on a topic. Subscribers receive values decoded
+// into the channel element type, unless it's Event, in which case they also
+// learn which topic a wildcard subscription matched.
+type Event struct {
+	Topic string          `json:"topic"`
+	Value json.RawMessage `json:"value"`
+}
+
+var eventType = reflect.TypeOf(Event{})
+
+// EventFilter selects events by top-level fields of published values, an
+// event is delivered when all fields in the filter are equal to the ones in
+// the value
+type EventFilter map[string]interface{}
+
+// SubscribeAuthFunc checks whether a subscription to a topic pattern is
+// allowed, the context carries whatever the transport put there, like
+// permissions set by auth.Handler
+type SubscribeAuthFunc func(ctx context.Context, topic string) error
+
+type subscriber struct {
+	pattern []string
+	filter  EventFilter
+	ch      chan Event
+}
+
+// pubSub is the hub behind RPCServer.Publish, its Subscribe method is
+// registered as subscribeMethod
+type pubSub struct {
+	lk   sync.Mutex
+	subs map[*subscriber]struct{}
+
+	auth SubscribeAuthFunc
+}
+
+func newPubSub(auth SubscribeAuthFunc) *pubSub {
+	return &pubSub{
+		subs: map[*subscriber]struct{}{},
+		auth: auth,
+	}
+}
+
+// Subscribe returns a channel of events published on topics matching the
+// pattern. Topics are dot-separated, in patterns `*` matches a single segment
+// and a trailing `>` matches one or more segments.
+func (p *pubSub) Subscribe(ctx context.Context, pattern string, filter EventFilter) (<-chan Event, error) {
+	if err := validTopic(pattern, true); err != nil {
+		return nil, err
+	}
+	if p.auth != nil {
+		if err := p.auth(ctx, pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	sub := &subscriber{
+		pattern: strings.Split(pattern, "."),
+		filter:  filter,
+		ch:      make(chan Event, subscriberBuffer),
+	}
+
+	p.lk.Lock()
+	p.subs[sub] = struct{}{}
+	p.lk.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		p.unsubscribe(sub)
+	}()
+
+	return sub.ch, nil
+}
+
+// unsubscribe removes a subscriber and closes its channel, unless that
+// already happened
+func (p *pubSub) unsubscribe(sub *subscriber) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	p.remove(sub)
+}
+
+func (p *pubSub) remove(sub *subscriber) {
+	if _, ok := p.subs[sub]; !ok {
+		return
+	}
+	delete(p.subs, sub)
+	close(sub.ch)
+}
+
+func (p *pubSub) publish(topic string, value interface{}) error {
+	if err := validTopic(topic, false); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return xerrors.Errorf("marshaling event: %w", err)
+	}
+	ev := Event{Topic: topic, Value: data}
+	segments := strings.Split(topic, ".")
+
+	// decoded lazily, only when a matching subscriber has a filter
+	var fields map[string]interface{}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	for sub := range p.subs {
+		if !topicMatches(sub.pattern, segments) {
+			continue
+		}
+		if len(sub.filter) > 0 {
+			if fields == nil {
+				fields = map[string]interface{}{}
+				if err := json.Unmarshal(data, &fields); err != nil {
+					log.Debugw("event value is not an object, filters won't match", "topic", topic, "error", err)
+				}
+			}
+			if !filterMatches(sub.filter, fields) {
+				continue
+			}
+		}
+
+		select {
+		case sub.ch <- ev:
+		default:
+			log.Warnw("subscriber is too slow, unsubscribing", "pattern", strings.Join(sub.pattern, "."))
+			p.remove(sub)
+		}
+	}
+	return nil
+}
+
+func validTopic(topic string, pattern bool) error {
+	if topic == "" {
+		return xerrors.New("empty topic")
+	}
+	segments := strings.Split(topic, ".")
+	for i, s := range segments {
+		switch {
+		case s == "":
+			return xerrors.Errorf("topic '%s': empty segment", topic)
+		case !pattern && (s == "*" || s == ">"):
+			return xerrors.Errorf("topic '%s': wildcards are only allowed in subscriptions", topic)
+		case s == ">" && i != len(segments)-1:
+			return xerrors.Errorf("topic '%s': '>' must be the last segment", topic)
+		}
+	}
+	return nil
+}
+
+func topicMatches(pattern, topic []string) bool {
+	for i, p := range pattern {
+		if p == ">" {
+			return len(topic) > i
+		}
+		if i >= len(topic) || (p != "*" && p != topic[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
+
+func filterMatches(filter EventFilter, fields map[string]interface{}) bool {
+	for k, want := range filter {
+		got, ok := fields[k]
+		if !ok {
+			return false
+		}
+		// compare as decoded JSON, so that e.g. numbers match regardless of
+		// the Go type they were set with
+		wantData, err := json.Marshal(want)
+		if err != nil {
+			return false
+		}
+		var wantJSON interface{}
+		if err := json.Unmarshal(wantData, &wantJSON); err != nil {
+			return false
+		}
+		if !reflect.DeepEqual(wantJSON, got) {
+			return false
+		}
+	}
+	return true
+}
+
+// Publish sends value to clients subscribed to a pattern matching topic.
+// Topics are dot-separated names, like "chain.head". Values are delivered as
+// JSON, a subscriber which can't keep up is unsubscribed, closing its
+// channel.
+func (s *RPCServer) Publish(topic string, value interface{}) error {
+	return s.pubSub.publish(topic, value)
+}
@@ -0,0 +1,400 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Recording is a call recorded by a server set up with WithRecording.
+// Recordings are written as JSON lines, which Replay and ReplayHTTP read.
+type Recording struct {
+	Time      time.Time         `json:"time"`
+	Method    string            `json:"method"`
+	Principal string            `json:"principal,omitempty"`
+	Meta      Meta              `json:"meta,omitempty"`
+	Params    []json.RawMessage `json:"params"`
+	Result    json.RawMessage   `json:"result,omitempty"`
+	Error     *RecordedError    `json:"error,omitempty"`
+
+	// Duration is the time from the start of the call until the response
+	// was ready, in nanoseconds
+	Duration time.Duration `json:"duration"`
+}
+
+// RecordedError is the error of a recorded or replayed call
+type RecordedError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// RecordConfig selects which calls are recorded, see WithRecording
+type RecordConfig struct {
+	// Methods limits recording to calls of the methods, calls of all
+	// methods are recorded when empty
+	Methods []string
+
+	// Principal returns who made a call, e.g. from values set in the context
+	// by an authentication middleware, or from RequestMeta. It's included in
+	// recordings and used to match Principals.
+	Principal func(ctx context.Context) string
+
+	// Principals limits recording to calls made by the principals
+	Principals []string
+
+	// SampleRate is the fraction of selected calls which are recorded, 0 is
+	// the same as 1 and records all of them
+	SampleRate float64
+}
+
+// callMeta are request metadata keys which only make sense for the call
+// they were sent with, they aren't recorded or replayed
+var callMeta = map[string]bool{
+	metaIdempotencyKey: true,
+	metaTimeout:        true,
+	metaTraceparent:    true,
+	metaTracestate:     true,
+	metaSpanContext:    true,
+}
+
+// recordedMeta returns the metadata of a call without callMeta keys
+func recordedMeta(meta map[string]string) Meta {
+	var out Meta
+	for k, v := range meta {
+		if callMeta[k] {
+			continue
+		}
+		if out == nil {
+			out = Meta{}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// replayKey marks contexts of calls replayed in-process, which aren't
+// recorded again
+type replayKey struct{}
+
+// recorder writes recordings of calls selected by a RecordConfig
+type recorder struct {
+	methods    map[string]bool
+	principals map[string]bool
+	principal  func(ctx context.Context) string
+	sampleRate float64
+
+	w io.Writer
+
+	// lk guards pending recordings, and writing, set while a call writes
+	// them to w
+	lk      sync.Mutex
+	pending []byte
+	writing bool
+}
+
+func newRecorder(w io.Writer, config RecordConfig) *recorder {
+	r := &recorder{
+		principal:  config.Principal,
+		sampleRate: config.SampleRate,
+		w:          w,
+	}
+	if len(config.Methods) > 0 {
+		r.methods = map[string]bool{}
+		for _, m := range config.Methods {
+			r.methods[m] = true
+		}
+	}
+	if len(config.Principals) > 0 {
+		r.principals = map[string]bool{}
+		for _, p := range config.Principals {
+			r.principals[p] = true
+		}
+	}
+	return r
+}
+
+// wrap returns a response writer which records the call when it's selected
+func (r *recorder) wrap(ctx context.Context, req request, wrtfun func(interface{})) func(interface{}) {
+	if r.methods != nil && !r.methods[req.Method] {
+		return wrtfun
+	}
+
+	var principal string
+	if r.principal != nil {
+		principal = r.principal(ctx)
+	}
+	if r.principals != nil && !r.principals[principal] {
+		return wrtfun
+	}
+
+	if r.sampleRate > 0 && rand.Float64() >= r.sampleRate {
+		return wrtfun
+	}
+
+	start := time.Now()
+	return func(v interface{}) {
+		// recorded before the response is sent, so that sequential calls
+		// find recordings of previous ones complete
+		if resp, ok := v.(response); ok {
+			r.record(req, principal, start, resp)
+		}
+		wrtfun(v)
+	}
+}
+
+func (r *recorder) record(req request, principal string, start time.Time, resp response) {
+	took := time.Since(start)
+
+	rec := Recording{
+		Time:      start,
+		Method:    req.Method,
+		Principal: principal,
+		Meta:      recordedMeta(req.Meta),
+		Params:    make([]json.RawMessage, len(req.Params)),
+		Duration:  took,
+	}
+	for i, p := range req.Params {
+		rec.Params[i] = p.data
+	}
+	if resp.Error != nil {
+		rec.Error = &RecordedError{Code: resp.Error.Code, Message: resp.Error.Message}
+	} else if resp.Result != nil {
+		res, err := json.Marshal(resp.Result)
+		if err != nil {
+			log.Errorf("recording call to '%s': marshaling result: %s", req.Method, err)
+			return
+		}
+		rec.Result = res
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("recording call to '%s': %s", req.Method, err)
+		return
+	}
+	r.write(append(line, '\n'))
+}
+
+// write queues a recording line. Unless another call is already writing,
+// queued lines are then written without holding the lock, so that calls
+// don't wait for each other's writes.
+func (r *recorder) write(line []byte) {
+	r.lk.Lock()
+	r.pending = append(r.pending, line...)
+	if r.writing {
+		r.lk.Unlock()
+		return
+	}
+	r.writing = true
+
+	for len(r.pending) > 0 {
+		buf := r.pending
+		r.pending = nil
+		r.lk.Unlock()
+
+		if _, err := r.w.Write(buf); err != nil {
+			log.Errorf("writing recordings: %s", err)
+		}
+
+		r.lk.Lock()
+	}
+	r.writing = false
+	r.lk.Unlock()
+}
+
+// ReplayResult is the outcome of replaying a recorded call
+type ReplayResult struct {
+	Recording Recording
+
+	Result   json.RawMessage
+	Error    *RecordedError
+	Duration time.Duration
+
+	// Diffs lists differences between the recorded response and the new
+	// one, like `result.items[1].name: "a" != "b"`. It's empty when the
+	// responses match.
+	Diffs []string
+}
+
+// Replay re-issues recorded calls, as written by a server set up with
+// WithRecording, against the server in-process, and compares the responses
+// with the recorded ones. Calls are made one at a time, in the order they
+// were recorded. Calls returning channels can't be replayed in-process, and
+// replayed calls aren't recorded again.
+func Replay(ctx context.Context, s *RPCServer, recordings io.Reader) ([]ReplayResult, error) {
+	return replay(ctx, recordings, func(ctx context.Context, body []byte) ([]byte, error) {
+		var out bytes.Buffer
+		s.handleReader(context.WithValue(ctx, replayKey{}, true), bytes.NewReader(body), &out, rpcError, nil)
+		return out.Bytes(), nil
+	})
+}
+
+// ReplayHTTP is like Replay, but sends the calls to a remote server over HTTP
+// with the client, e.g. one set up for TLS. http.DefaultClient is used when
+// it's nil.
+func ReplayHTTP(ctx context.Context, hc *http.Client, addr string, requestHeader http.Header, recordings io.Reader) ([]ReplayResult, error) {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return replay(ctx, recordings, func(ctx context.Context, body []byte) ([]byte, error) {
+		hreq, err := http.NewRequestWithContext(ctx, "POST", addr, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range requestHeader {
+			hreq.Header[k] = v
+		}
+		hreq.Header.Set("Content-Type", "application/json")
+
+		hresp, err := hc.Do(hreq)
+		if err != nil {
+			return nil, err
+		}
+		defer hresp.Body.Close() // nolint
+
+		return ioutil.ReadAll(hresp.Body)
+	})
+}
+
+func replay(ctx context.Context, recordings io.Reader, call func(ctx context.Context, body []byte) ([]byte, error)) ([]ReplayResult, error) {
+	var results []ReplayResult
+
+	dec := json.NewDecoder(recordings)
+	for id := int64(1); ; id++ {
+		var rec Recording
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return results, nil
+			}
+			return results, xerrors.Errorf("reading recording %d: %w", id, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		req := request{
+			Jsonrpc: "2.0",
+			ID:      &id,
+			Method:  rec.Method,
+			Params:  make([]param, len(rec.Params)),
+			Meta:    recordedMeta(rec.Meta), // in case recordings were edited
+		}
+		for i, p := range rec.Params {
+			req.Params[i] = param{data: p}
+		}
+		body, err := json.Marshal(req)
+		if err != nil {
+			return results, xerrors.Errorf("marshaling call %d to '%s': %w", id, rec.Method, err)
+		}
+
+		start := time.Now()
+		out, err := call(ctx, body)
+		if err != nil {
+			return results, xerrors.Errorf("replaying call %d to '%s': %w", id, rec.Method, err)
+		}
+
+		var resp struct {
+			Result json.RawMessage `json:"result"`
+			Error  *RecordedError  `json:"error"`
+		}
+		if err := json.Unmarshal(out, &resp); err != nil {
+			return results, xerrors.Errorf("unmarshaling response to call %d to '%s': %w", id, rec.Method, err)
+		}
+
+		results = append(results, ReplayResult{
+			Recording: rec,
+			Result:    resp.Result,
+			Error:     resp.Error,
+			Duration:  time.Since(start),
+			Diffs:     diffResponses(rec, resp.Result, resp.Error),
+		})
+	}
+}
+
+// diffResponses compares a replayed response with the recorded one
+func diffResponses(rec Recording, result json.RawMessage, rerr *RecordedError) []string {
+	if rec.Error != nil || rerr != nil {
+		if rec.Error == nil || rerr == nil || *rec.Error != *rerr {
+			return []string{fmt.Sprintf("error: %s != %s", describeError(rec.Error), describeError(rerr))}
+		}
+		return nil
+	}
+
+	var recorded, replayed interface{}
+	if err := decodeValue(rec.Result, &recorded, UseNumber); len(rec.Result) > 0 && err != nil {
+		return []string{fmt.Sprintf("result: recorded result is invalid: %s", err)}
+	}
+	if err := decodeValue(result, &replayed, UseNumber); len(result) > 0 && err != nil {
+		return []string{fmt.Sprintf("result: invalid result: %s", err)}
+	}
+
+	var diffs []string
+	diffJSON("result", recorded, replayed, &diffs)
+	return diffs
+}
+
+func describeError(e *RecordedError) string {
+	if e == nil {
+		return "no error"
+	}
+	return fmt.Sprintf("(%d) %q", e.Code, e.Message)
+}
+
+// diffJSON lists paths where decoded JSON values differ
+func diffJSON(path string, a, b interface{}, diffs *[]string) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			diffJSON(path+"."+k, av[k], bv[k], diffs)
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			break
+		}
+		for i := range av {
+			diffJSON(fmt.Sprintf("%s[%d]", path, i), av[i], bv[i], diffs)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		*diffs = append(*diffs, fmt.Sprintf("%s: %s != %s", path, jsonString(a), jsonString(b)))
+	}
+}
+
+func jsonString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
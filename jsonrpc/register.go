@@ -0,0 +1,405 @@
+package jsonrpc
+
+import (
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"gitee.com/huanghua_2017/hggutils/jsonrpc/auth"
+	"golang.org/x/xerrors"
+)
+
+// RegisterOption configures which methods of a handler are registered, and
+// how
+type RegisterOption func(c *registerConfig)
+
+type registerConfig struct {
+	include       map[string]bool
+	exclude       map[string]bool
+	nameTransform func(string) string
+	methodOpts    map[string][]MethodOption
+}
+
+// WithIncludeMethods registers only the listed methods (Go method names) of
+// the handler
+func WithIncludeMethods(methods ...string) RegisterOption {
+	return func(c *registerConfig) {
+		if c.include == nil {
+			c.include = map[string]bool{}
+		}
+		for _, m := range methods {
+			c.include[m] = true
+		}
+	}
+}
+
+// WithExcludeMethods skips the listed methods (Go method names) of the
+// handler, e.g. helpers which are exported but not meant to be called
+// remotely
+func WithExcludeMethods(methods ...string) RegisterOption {
+	return func(c *registerConfig) {
+		if c.exclude == nil {
+			c.exclude = map[string]bool{}
+		}
+		for _, m := range methods {
+			c.exclude[m] = true
+		}
+	}
+}
+
+// WithNameTransform changes how Go method names map to RPC method names,
+// e.g. with LowerCamelCase or SnakeCase. The namespace isn't transformed.
+func WithNameTransform(transform func(string) string) RegisterOption {
+	return func(c *registerConfig) {
+		c.nameTransform = transform
+	}
+}
+
+// WithMethodOptions sets options for a single method (Go method name) of the
+// handler
+func WithMethodOptions(method string, opts ...MethodOption) RegisterOption {
+	return func(c *registerConfig) {
+		if c.methodOpts == nil {
+			c.methodOpts = map[string][]MethodOption{}
+		}
+		c.methodOpts[method] = append(c.methodOpts[method], opts...)
+	}
+}
+
+// MethodOption configures a single registered method
+type MethodOption func(o *methodOptions)
+
+type methodOptions struct {
+	timeout      *methodTimeout
+	perm         auth.Permission
+	readOnly     bool
+	cacheControl string
+	cache        *CacheConfig
+}
+
+// MethodTimeout is like the WithMethodTimeout server option, which takes
+// precedence when both are set
+func MethodTimeout(def, max time.Duration) MethodOption {
+	return func(o *methodOptions) {
+		o.timeout = &methodTimeout{def: def, max: max}
+	}
+}
+
+// MethodPermission requires callers to have the permission, as set in the
+// call context by auth.Handler
+func MethodPermission(perm auth.Permission) MethodOption {
+	return func(o *methodOptions) {
+		o.perm = perm
+	}
+}
+
+// MethodReadOnly is like the WithReadOnly server option
+func MethodReadOnly(cacheControl string) MethodOption {
+	return func(o *methodOptions) {
+		o.readOnly = true
+		o.cacheControl = cacheControl
+	}
+}
+
+// MethodCache is like the WithMethodCache server option, which takes
+// precedence when both are set
+func MethodCache(config CacheConfig) MethodOption {
+	return func(o *methodOptions) {
+		o.cache = &config
+	}
+}
+
+// LowerCamelCase turns method names like GetHTTPStatus into getHTTPStatus
+func LowerCamelCase(name string) string {
+	r := []rune(name)
+
+	upper := 0
+	for upper < len(r) && unicode.IsUpper(r[upper]) {
+		upper++
+	}
+	// keep the last capital of a leading acronym, it starts the next word
+	if upper > 1 && upper < len(r) && unicode.IsLower(r[upper]) {
+		upper--
+	}
+
+	for i := 0; i < upper; i++ {
+		r[i] = unicode.ToLower(r[i])
+	}
+	return string(r)
+}
+
+// SnakeCase turns method names like GetHTTPStatus into get_http_status
+func SnakeCase(name string) string {
+	r := []rune(name)
+
+	var sb strings.Builder
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) {
+			prev := r[i-1]
+			nextLower := i+1 < len(r) && unicode.IsLower(r[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				sb.WriteByte('_')
+			}
+		}
+		sb.WriteRune(unicode.ToLower(c))
+	}
+	return sb.String()
+}
+
+func (s *RPCServer) register(namespace string, r interface{}, opts ...RegisterOption) error {
+	var config registerConfig
+	for _, o := range opts {
+		o(&config)
+	}
+
+	val := reflect.ValueOf(r)
+	typ := val.Type()
+	//TODO: expect ptr
+
+	// catch typos in method lists
+	for _, names := range []map[string]bool{config.include, config.exclude} {
+		for name := range names {
+			if _, ok := typ.MethodByName(name); !ok {
+				return xerrors.Errorf("method %s not found on %s", name, typ)
+			}
+		}
+	}
+	for name := range config.methodOpts {
+		if _, ok := typ.MethodByName(name); !ok {
+			return xerrors.Errorf("method %s not found on %s", name, typ)
+		}
+	}
+
+	handlers := map[string]rpcHandler{}
+	for i := 0; i < val.NumMethod(); i++ {
+		method := typ.Method(i)
+		if config.include != nil && !config.include[method.Name] {
+			continue
+		}
+		if config.exclude[method.Name] {
+			continue
+		}
+
+		var mopts methodOptions
+		for _, o := range config.methodOpts[method.Name] {
+			o(&mopts)
+		}
+
+		h, err := newRPCHandler(val.Method(i), mopts)
+		if err != nil {
+			return xerrors.Errorf("method %s: %w", method.Name, err)
+		}
+
+		name := method.Name
+		if config.nameTransform != nil {
+			name = config.nameTransform(name)
+		}
+		name = namespace + "." + name
+		if _, dup := handlers[name]; dup {
+			return xerrors.Errorf("method %s: name %s used by another method", method.Name, name)
+		}
+
+		handlers[name] = h
+	}
+
+	return s.addMethods(handlers)
+}
+
+// newRPCHandler creates a handler for a bound method or a plain function
+func newRPCHandler(fn reflect.Value, opts methodOptions) (rpcHandler, error) {
+	funcType := fn.Type()
+	if funcType.IsVariadic() {
+		return rpcHandler{}, xerrors.New("variadic functions aren't supported")
+	}
+
+	hasCtx := 0
+	if funcType.NumIn() >= 1 && funcType.In(0) == contextType {
+		hasCtx = 1
+	}
+
+	ins := funcType.NumIn() - hasCtx
+	recvs := make([]reflect.Type, ins)
+	for i := 0; i < ins; i++ {
+		recvs[i] = funcType.In(i + hasCtx)
+	}
+
+	valOut, errOut, _, err := funcOuts(funcType)
+	if err != nil {
+		return rpcHandler{}, err
+	}
+
+	h := rpcHandler{
+		paramReceivers: recvs,
+		nParams:        ins,
+
+		handlerFunc: fn,
+
+		hasCtx: hasCtx,
+
+		errOut: errOut,
+		valOut: valOut,
+
+		opts: opts,
+	}
+	if opts.cache != nil {
+		h.cache = newMethodCache(*opts.cache)
+	}
+	return h, nil
+}
+
+// addMethods adds handlers, unless any of the names is already registered
+func (s *RPCServer) addMethods(handlers map[string]rpcHandler) error {
+	s.methodsLk.Lock()
+	defer s.methodsLk.Unlock()
+
+	for name := range handlers {
+		if _, ok := s.methods[name]; ok {
+			return xerrors.Errorf("method %s already registered", name)
+		}
+	}
+	for name, h := range handlers {
+		s.methods[name] = h
+	}
+	return nil
+}
+
+// lookupMethod finds a registered method by name or alias, the name of the
+// method is returned with it
+func (s *RPCServer) lookupMethod(name string) (rpcHandler, string, bool) {
+	s.methodsLk.RLock()
+	defer s.methodsLk.RUnlock()
+
+	if h, ok := s.methods[name]; ok {
+		return h, name, true
+	}
+	if original, ok := s.aliasedMethods[name]; ok {
+		h, ok := s.methods[original]
+		return h, original, ok
+	}
+	return rpcHandler{}, "", false
+}
+
+// Register registers new RPC handler
+//
+// Handler is any value with methods defined. Register panics when methods
+// can't be registered, TryRegister returns an error instead.
+func (s *RPCServer) Register(namespace string, handler interface{}, opts ...RegisterOption) {
+	if err := s.TryRegister(namespace, handler, opts...); err != nil {
+		panic(err)
+	}
+}
+
+// TryRegister is like Register, but returns an error when a method has an
+// unsupported signature, or its name is already registered. Nothing is
+// registered in that case.
+func (s *RPCServer) TryRegister(namespace string, handler interface{}, opts ...RegisterOption) error {
+	if err := s.register(namespace, handler, opts...); err != nil {
+		return xerrors.Errorf("registering %s: %w", namespace, err)
+	}
+	return nil
+}
+
+// RegisterFunc registers a function or closure as the method name, which
+// is the full name used by clients, e.g. "Namespace.Method". Functions can
+// take a context.Context as the first param, like methods of handlers passed
+// to Register. RegisterFunc panics when the function can't be registered.
+func (s *RPCServer) RegisterFunc(name string, fn interface{}, opts ...MethodOption) {
+	if err := s.TryRegisterFunc(name, fn, opts...); err != nil {
+		panic(err)
+	}
+}
+
+// TryRegisterFunc is like RegisterFunc, but returns an error instead of
+// panicking
+func (s *RPCServer) TryRegisterFunc(name string, fn interface{}, opts ...MethodOption) error {
+	val := reflect.ValueOf(fn)
+	if val.Kind() != reflect.Func || val.IsNil() {
+		return xerrors.Errorf("registering %s: expected a function, got %T", name, fn)
+	}
+
+	var mopts methodOptions
+	for _, o := range opts {
+		o(&mopts)
+	}
+
+	h, err := newRPCHandler(val, mopts)
+	if err != nil {
+		return xerrors.Errorf("registering %s: %w", name, err)
+	}
+
+	if err := s.addMethods(map[string]rpcHandler{name: h}); err != nil {
+		return xerrors.Errorf("registering %s: %w", name, err)
+	}
+	return nil
+}
+
+// RegisterTyped registers a handler shaped like
+//
+//	func(ctx context.Context, req Req) (Resp, error)
+//
+// which takes a single request value, usually a struct, and returns a single
+// response. Without type parameters the shape is checked when registering,
+// so mistakes surface at startup rather than on the first call.
+// RegisterTyped panics when the function can't be registered.
+func (s *RPCServer) RegisterTyped(name string, fn interface{}, opts ...MethodOption) {
+	if err := s.TryRegisterTyped(name, fn, opts...); err != nil {
+		panic(err)
+	}
+}
+
+// TryRegisterTyped is like RegisterTyped, but returns an error instead of
+// panicking
+func (s *RPCServer) TryRegisterTyped(name string, fn interface{}, opts ...MethodOption) error {
+	typ := reflect.TypeOf(fn)
+	if typ == nil || typ.Kind() != reflect.Func ||
+		typ.NumIn() != 2 || typ.In(0) != contextType ||
+		typ.NumOut() != 2 || typ.Out(1) != errorType {
+		return xerrors.Errorf("registering %s: expected func(context.Context, Req) (Resp, error), got %T", name, fn)
+	}
+
+	return s.TryRegisterFunc(name, fn, opts...)
+}
+
+// Unregister removes all methods registered in the namespace, along with
+// aliases to them, so that it can be registered again with another handler.
+// Cached responses of the methods are dropped, while the WithReadOnly and
+// WithMethodCache server options keep applying to methods registered again
+// under the same names. Calls already running aren't affected. An error is
+// returned for the built-in xrpc namespace, and for namespaces without
+// registered methods.
+func (s *RPCServer) Unregister(namespace string) error {
+	if namespace == builtinNamespace {
+		return xerrors.Errorf("namespace %s can't be unregistered", namespace)
+	}
+	prefix := namespace + "."
+
+	s.methodsLk.Lock()
+	found := false
+	for name := range s.methods {
+		if strings.HasPrefix(name, prefix) {
+			delete(s.methods, name)
+			found = true
+		}
+	}
+	for alias, original := range s.aliasedMethods {
+		if strings.HasPrefix(original, prefix) {
+			delete(s.aliasedMethods, alias)
+		}
+	}
+	s.methodsLk.Unlock()
+
+	if !found {
+		return xerrors.Errorf("namespace %s has no registered methods", namespace)
+	}
+
+	s.InvalidateCachePrefix(prefix)
+	return nil
+}
+
+func (s *RPCServer) AliasMethod(alias, original string) {
+	s.methodsLk.Lock()
+	defer s.methodsLk.Unlock()
+
+	s.aliasedMethods[alias] = original
+}
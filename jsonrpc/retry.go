@@ -0,0 +1,158 @@
+package jsonrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// metaIdempotencyKey identifies a logical call across retry attempts, servers
+// with deduplication enabled execute a call at most once per key
+const metaIdempotencyKey = "idempotency-key"
+
+// RetryPolicy controls automatic retries of failed calls. It applies to
+// methods of a client tagged with `retry:"true"`, which should be idempotent,
+// or the server should deduplicate calls using WithDeduplication. Methods
+// without the tag are only retried when the call surely wasn't processed: it
+// couldn't be sent, or the server refused it while shutting down. Methods
+// tagged with `retry:"false"` aren't retried.
+type RetryPolicy struct {
+	// MaxAttempts limits the number of attempts, including the first one.
+	// Zero means no limit.
+	MaxAttempts int
+	// Budget limits the total time spent on a call, including delays between
+	// attempts. Zero means no limit.
+	Budget time.Duration
+
+	// Delay between attempts grows exponentially between MinDelay and MaxDelay
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	// RetryNetwork retries connection errors, closed websocket connections and
+	// servers which are unavailable or shutting down
+	RetryNetwork bool
+	// RetryTimeout retries calls which timed out on the server or in a gateway
+	RetryTimeout bool
+	// RetryCodes lists additional JSON-RPC error codes to retry on
+	RetryCodes []int
+}
+
+// legacyRetryPolicy is used for methods tagged with `retry:"true"` when no
+// policy is set on the client; they are retried forever when the websocket
+// connection gets closed.
+var legacyRetryPolicy = &RetryPolicy{
+	MinDelay:   methodMinRetryDelay,
+	MaxDelay:   methodMaxRetryDelay,
+	RetryCodes: []int{2},
+}
+
+// nextDelay returns the delay before the next attempt, false is returned if
+// the call shouldn't be retried
+func (p *RetryPolicy) nextDelay(ctx context.Context, attempt int, deadline time.Time, resp clientResponse, err error) (time.Duration, bool) {
+	if !p.retryable(resp, err) {
+		return 0, false
+	}
+	if p.MaxAttempts > 0 && attempt+1 >= p.MaxAttempts {
+		return 0, false
+	}
+	if ctx.Err() != nil {
+		return 0, false
+	}
+
+	b := backoff{
+		minDelay: p.MinDelay,
+		maxDelay: p.MaxDelay,
+	}
+	delay := b.next(attempt)
+	if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+		return 0, false
+	}
+
+	return delay, true
+}
+
+func (p *RetryPolicy) retryable(resp clientResponse, err error) bool {
+	if err != nil {
+		var statusErr *errHTTPStatus
+		if xerrors.As(err, &statusErr) {
+			switch statusErr.code {
+			case http.StatusGatewayTimeout:
+				return p.RetryTimeout
+			default:
+				return p.RetryNetwork
+			}
+		}
+
+		var netErr net.Error
+		if xerrors.As(err, &netErr) {
+			if netErr.Timeout() {
+				return p.RetryTimeout
+			}
+			return p.RetryNetwork
+		}
+
+		if xerrors.Is(err, io.EOF) || xerrors.Is(err, io.ErrUnexpectedEOF) {
+			return p.RetryNetwork
+		}
+		return false
+	}
+
+	if resp.Error == nil {
+		return false
+	}
+
+	switch resp.Error.Code {
+	case 2, rpcShuttingDown:
+		if p.RetryNetwork {
+			return true
+		}
+	case rpcTimeout:
+		if p.RetryTimeout {
+			return true
+		}
+	}
+
+	for _, code := range p.RetryCodes {
+		if resp.Error.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// refused reports whether a call surely wasn't processed by the server,
+// because it couldn't be sent or the server refused it
+func refused(resp clientResponse, err error) bool {
+	if err != nil {
+		var statusErr *errHTTPStatus
+		if xerrors.As(err, &statusErr) {
+			return statusErr.code == http.StatusServiceUnavailable
+		}
+		return isDialError(err)
+	}
+	return resp.Error != nil && resp.Error.Code == rpcShuttingDown
+}
+
+func newIdempotencyKey() string {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		log.Errorw("generating idempotency key", "error", err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
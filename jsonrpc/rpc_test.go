@@ -1,25 +1,35 @@
 package jsonrpc
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"gitee.com/huanghua_2017/hggutils/jsonrpc/auth"
+	"gitee.com/huanghua_2017/hggutils/jsonrpc/metrics"
 	"github.com/gorilla/websocket"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
 )
 
 func init() {
@@ -89,16 +99,16 @@ func TestReconnection(t *testing.T) {
 	timer := time.NewTimer(captureDuration)
 
 	// record the number of connection attempts during this test
-	connectionAttempts := 1
+	connectionAttempts := int64(1)
 
 	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "SimpleServerHandler", []interface{}{&rpcClient}, nil, func(c *Config) {
 		c.proxyConnFactory = func(f func() (*websocket.Conn, error)) func() (*websocket.Conn, error) {
 			return func() (*websocket.Conn, error) {
 				defer func() {
-					connectionAttempts++
+					atomic.AddInt64(&connectionAttempts, 1)
 				}()
 
-				if connectionAttempts > 1 {
+				if atomic.LoadInt64(&connectionAttempts) > 1 {
 					return nil, errors.New("simulates a failed reconnect attempt")
 				}
 
@@ -121,7 +131,7 @@ func TestReconnection(t *testing.T) {
 	<-timer.C
 
 	// do some math
-	attemptsPerSecond := int64(connectionAttempts) / int64(captureDuration/time.Second)
+	attemptsPerSecond := atomic.LoadInt64(&connectionAttempts) / int64(captureDuration/time.Second)
 
 	assert.Less(t, attemptsPerSecond, int64(50))
 }
@@ -701,10 +711,11 @@ func TestChanServerClose(t *testing.T) {
 
 	tctx, tcancel := context.WithCancel(context.Background())
 
-	testServ := httptest.NewServer(rpcServer)
+	testServ := httptest.NewUnstartedServer(rpcServer)
 	testServ.Config.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
 		return tctx
 	}
+	testServ.Start()
 
 	closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "ChanHandler", &client, nil)
 	require.NoError(t, err)
@@ -832,10 +843,11 @@ func TestChanClientReceiveAll(t *testing.T) {
 
 	tctx, tcancel := context.WithCancel(context.Background())
 
-	testServ := httptest.NewServer(rpcServer)
+	testServ := httptest.NewUnstartedServer(rpcServer)
 	testServ.Config.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
 		return tctx
 	}
+	testServ.Start()
 
 	closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "ChanHandler", &client, nil)
 	require.NoError(t, err)
@@ -991,3 +1003,2556 @@ func readerDec(ctx context.Context, rin []byte) (reflect.Value, error) {
 
 	return reflect.ValueOf(readerRegistery[id]), nil
 }
+
+func TestPrometheusMetrics(t *testing.T) {
+	require.NoError(t, view.Register(metrics.DefaultViews...))
+	defer view.Unregister(metrics.DefaultViews...)
+
+	var client struct {
+		AddGet func(int) int
+	}
+
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	closer, err := NewClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "SimpleServerHandler", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	require.Equal(t, 2, client.AddGet(2))
+
+	rec := httptest.NewRecorder()
+	metrics.PrometheusHandler("test").ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	out := rec.Body.String()
+	require.Contains(t, out, "# TYPE test_rpc_requests_total counter")
+	require.Contains(t, out, `test_rpc_requests_total{method="SimpleServerHandler.AddGet"} 1`)
+	require.Contains(t, out, `test_rpc_request_duration_ms_count{method="SimpleServerHandler.AddGet"} 1`)
+	require.Contains(t, out, "# TYPE test_rpc_requests_in_flight gauge")
+	require.Contains(t, out, `test_rpc_requests_in_flight{method="SimpleServerHandler.AddGet"} 0`)
+}
+
+type TraceHandler struct {
+	traceID trace.TraceID
+}
+
+func (h *TraceHandler) Get(ctx context.Context) error {
+	h.traceID = trace.FromContext(ctx).SpanContext().TraceID
+	return nil
+}
+
+func TestTraceparent(t *testing.T) {
+	sc, ok := parseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	require.True(t, ok)
+	require.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", formatTraceparent(sc))
+
+	_, ok = parseTraceparent("00-00000000000000000000000000000000-b7ad6b7169203331-01")
+	require.False(t, ok)
+	_, ok = parseTraceparent("ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	require.False(t, ok)
+
+	ts := parseTracestate("congo=t61rcWkgMzE, rojo=00f067aa0ba902b7")
+	require.Equal(t, "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7", formatTracestate(ts))
+
+	var client struct {
+		Get func(context.Context) error
+	}
+
+	serverHandler := &TraceHandler{}
+
+	rpcServer := NewServer()
+	rpcServer.Register("TraceHandler", serverHandler)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	for _, proto := range []string{"http://", "ws://"} {
+		closer, err := NewClient(context.Background(), proto+testServ.Listener.Addr().String(), "TraceHandler", &client, nil)
+		require.NoError(t, err)
+
+		ctx, span := trace.StartSpan(context.Background(), "test")
+		require.NoError(t, client.Get(ctx))
+		span.End()
+
+		require.Equal(t, span.SpanContext().TraceID, serverHandler.traceID)
+		closer()
+	}
+}
+
+type MetaHandler struct{}
+
+func (h *MetaHandler) Tenant(ctx context.Context) (string, error) {
+	SetResponseMeta(ctx, "request-id", "r-1")
+	return RequestMeta(ctx)["tenant"], nil
+}
+
+func TestMeta(t *testing.T) {
+	var client struct {
+		Tenant func(context.Context) (string, error)
+	}
+
+	rpcServer := NewServer()
+	rpcServer.Register("MetaHandler", &MetaHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	for _, proto := range []string{"http://", "ws://"} {
+		closer, err := NewClient(context.Background(), proto+testServ.Listener.Addr().String(), "MetaHandler", &client, nil)
+		require.NoError(t, err)
+
+		respMeta := Meta{}
+		ctx := WithMeta(context.Background(), "tenant", "t-1")
+		ctx = WithResponseMeta(ctx, respMeta)
+
+		tenant, err := client.Tenant(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "t-1", tenant)
+		require.Equal(t, "r-1", respMeta["request-id"])
+
+		tenant, err = client.Tenant(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "", tenant)
+
+		closer()
+	}
+}
+
+type SlowHandler struct{}
+
+func (h *SlowHandler) Sleep(d time.Duration) error {
+	time.Sleep(d)
+	return nil
+}
+
+func (h *SlowHandler) Deadline(ctx context.Context) (bool, error) {
+	_, ok := ctx.Deadline()
+	return ok, nil
+}
+
+func TestTimeouts(t *testing.T) {
+	var client struct {
+		Sleep    func(time.Duration) error
+		Deadline func(context.Context) (bool, error)
+	}
+
+	rpcServer := NewServer(
+		WithDefaultTimeout(50*time.Millisecond),
+		WithMethodTimeout("SlowHandler.Deadline", -1, 0))
+	rpcServer.Register("SlowHandler", &SlowHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	for _, proto := range []string{"http://", "ws://"} {
+		closer, err := NewClient(context.Background(), proto+testServ.Listener.Addr().String(), "SlowHandler", &client, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, client.Sleep(time.Millisecond))
+
+		err = client.Sleep(time.Second)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "RPC error (-32001)")
+
+		// no default for this method
+		hasDeadline, err := client.Deadline(context.Background())
+		require.NoError(t, err)
+		require.False(t, hasDeadline)
+
+		// client deadline is propagated
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		hasDeadline, err = client.Deadline(ctx)
+		cancel()
+		require.NoError(t, err)
+		require.True(t, hasDeadline)
+
+		closer()
+	}
+
+	// calls which timed out are in flight until the handler returns
+	closer, err := NewClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "SlowHandler", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	start := time.Now()
+	require.Error(t, client.Sleep(300*time.Millisecond))
+	require.Less(t, int64(time.Since(start)), int64(300*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, rpcServer.Shutdown(ctx))
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(300*time.Millisecond))
+}
+
+func TestShutdown(t *testing.T) {
+	var client struct {
+		Sleep func(time.Duration) error
+		Sub   func(context.Context, int, int) (<-chan int, error)
+	}
+
+	chanHandler := &ChanHandler{
+		wait: make(chan struct{}, 5),
+	}
+
+	rpcServer := NewServer()
+	rpcServer.Register("Handler", &SlowHandler{})
+	rpcServer.Register("Handler", chanHandler)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Handler", []interface{}{&client}, nil, WithNoReconnect())
+	require.NoError(t, err)
+	defer closer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub, err := client.Sub(ctx, 1, -1)
+	require.NoError(t, err)
+
+	callErr := make(chan error)
+	go func() {
+		callErr <- client.Sleep(200 * time.Millisecond)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	sctx, scancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer scancel()
+	require.NoError(t, rpcServer.Shutdown(sctx))
+
+	// in-flight call finished
+	require.NoError(t, <-callErr)
+
+	// subscription got closed
+	select {
+	case _, ok := <-sub:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("subscription not closed")
+	}
+
+	// new calls are rejected
+	var httpClient struct {
+		Sleep func(time.Duration) error
+	}
+	closer, err = NewClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "Handler", &httpClient, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	require.Error(t, httpClient.Sleep(0))
+}
+
+func TestShutdownForce(t *testing.T) {
+	var client struct {
+		Test func(ctx context.Context)
+	}
+
+	serverHandler := &CtxHandler{}
+
+	rpcServer := NewServer()
+	rpcServer.Register("CtxHandler", serverHandler)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "CtxHandler", []interface{}{&client}, nil, WithNoReconnect())
+	require.NoError(t, err)
+	defer closer()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.Test(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	sctx, scancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer scancel()
+	require.Equal(t, context.DeadlineExceeded, rpcServer.Shutdown(sctx))
+
+	<-done
+
+	serverHandler.lk.Lock()
+	defer serverHandler.lk.Unlock()
+	require.True(t, serverHandler.cancelled)
+}
+
+func TestMultiClientHttp(t *testing.T) {
+	var client struct {
+		AddGet func(int) int
+	}
+
+	handler1, handler2 := &SimpleServerHandler{}, &SimpleServerHandler{}
+
+	rpcServer1 := NewServer()
+	rpcServer1.Register("SimpleServerHandler", handler1)
+	testServ1 := httptest.NewServer(rpcServer1)
+	defer testServ1.Close()
+
+	rpcServer2 := NewServer()
+	rpcServer2.Register("SimpleServerHandler", handler2)
+	testServ2 := httptest.NewServer(rpcServer2)
+	defer testServ2.Close()
+
+	// reserve an address nothing listens on
+	dead := httptest.NewServer(rpcServer1)
+	deadAddr := "http://" + dead.Listener.Addr().String()
+	dead.Close()
+
+	addrs := []string{deadAddr, "http://" + testServ1.Listener.Addr().String(), "http://" + testServ2.Listener.Addr().String()}
+	closer, err := NewMultiClient(context.Background(), addrs, "SimpleServerHandler", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	for i := 0; i < 10; i++ {
+		client.AddGet(1)
+	}
+
+	// dead endpoint failed over, calls spread across the live ones
+	require.Equal(t, 10, handler1.n+handler2.n)
+	require.Equal(t, 5, handler1.n)
+	require.Equal(t, 5, handler2.n)
+}
+
+func TestMultiClientLeastInflight(t *testing.T) {
+	var client struct {
+		AddGet func(int) int
+		Sub    func(context.Context, int, int) (<-chan int, error)
+	}
+
+	for _, longPoll := range []bool{false, true} {
+		handler1, handler2 := &SimpleServerHandler{}, &SimpleServerHandler{}
+
+		rpcServer1 := NewServer()
+		rpcServer1.Register("Handler", handler1)
+		rpcServer1.Register("Handler", &ChanHandler{}, WithIncludeMethods("Sub"))
+		testServ1 := httptest.NewServer(rpcServer1)
+
+		rpcServer2 := NewServer()
+		rpcServer2.Register("Handler", handler2)
+		testServ2 := httptest.NewServer(rpcServer2)
+
+		opts := []Option{WithBalancePolicy(LeastInflight)}
+		if longPoll {
+			opts = append(opts, WithLongPoll())
+		}
+		addrs := []string{"http://" + testServ1.Listener.Addr().String(), "http://" + testServ2.Listener.Addr().String()}
+		closer, err := NewMultiClient(context.Background(), addrs, "Handler", []interface{}{&client}, nil, opts...)
+		require.NoError(t, err)
+
+		// the open channel counts as an in-flight call on the first endpoint
+		ctx, cancel := context.WithCancel(context.Background())
+		_, err = client.Sub(ctx, 1, -1)
+		require.NoError(t, err)
+
+		for i := 0; i < 4; i++ {
+			client.AddGet(1)
+		}
+		require.Equal(t, 0, handler1.n)
+		require.Equal(t, 4, handler2.n)
+
+		// until it's closed
+		cancel()
+		require.Eventually(t, func() bool {
+			return client.AddGet(1) == 1
+		}, 5*time.Second, 50*time.Millisecond)
+
+		closer()
+		testServ1.Close()
+		testServ2.Close()
+	}
+}
+
+func TestResolverNotBlocking(t *testing.T) {
+	block := make(chan struct{})
+	var resolves int32
+	resolver := func(ctx context.Context) ([]string, error) {
+		if atomic.AddInt32(&resolves, 1) > 1 {
+			<-block
+		}
+		return []string{"http://b"}, nil
+	}
+
+	pool, err := newEndpointPool(context.Background(), []string{"http://a"}, Config{resolver: resolver})
+	require.NoError(t, err)
+	require.Equal(t, 2, pool.size())
+
+	pool.resolvedAt = time.Time{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pool.release(pool.pick(context.Background(), nil))
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&resolves) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// other calls don't wait for the resolver
+	ep := pool.pick(context.Background(), nil)
+	pool.markFailed(ep)
+	pool.release(ep)
+
+	close(block)
+	<-done
+	require.Equal(t, 1, pool.size())
+}
+
+func TestMultiClientWsFailover(t *testing.T) {
+	var client struct {
+		AddGet func(int) int
+	}
+
+	handler1, handler2 := &SimpleServerHandler{}, &SimpleServerHandler{}
+
+	rpcServer1 := NewServer()
+	rpcServer1.Register("SimpleServerHandler", handler1)
+	testServ1 := httptest.NewServer(rpcServer1)
+	defer testServ1.Close()
+
+	rpcServer2 := NewServer()
+	rpcServer2.Register("SimpleServerHandler", handler2)
+	testServ2 := httptest.NewServer(rpcServer2)
+	defer testServ2.Close()
+
+	addrs := []string{"ws://" + testServ1.Listener.Addr().String(), "ws://" + testServ2.Listener.Addr().String()}
+	closer, err := NewMultiClient(context.Background(), addrs, "SimpleServerHandler", []interface{}{&client}, nil, WithBalancePolicy(Priority))
+	require.NoError(t, err)
+	defer closer()
+
+	require.Equal(t, 1, client.AddGet(1))
+	require.Equal(t, 1, handler1.n)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, rpcServer1.Shutdown(ctx))
+
+	require.Eventually(t, func() bool {
+		return client.AddGet(1) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, 1, handler1.n)
+}
+
+type FlakyHandler struct {
+	lk    sync.Mutex
+	calls int
+
+	// timeouts are the times left for calls to Timed
+	timeouts []time.Duration
+}
+
+func (h *FlakyHandler) Call() (int, error) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	h.calls++
+	if h.calls < 3 {
+		return 0, errors.New("flaky")
+	}
+	return h.calls, nil
+}
+
+func (h *FlakyHandler) Timed(ctx context.Context) error {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	h.timeouts = append(h.timeouts, time.Until(deadline))
+	if len(h.timeouts) < 3 {
+		return errors.New("flaky")
+	}
+	return nil
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var client struct {
+		Call     func() (int, error)         `retry:"true"`
+		CallOnce func() (int, error)         `alias:"Call"`
+		Timed    func(context.Context) error `retry:"true"`
+	}
+
+	policy := RetryPolicy{
+		MaxAttempts: 5,
+		MinDelay:    time.Millisecond,
+		MaxDelay:    10 * time.Millisecond,
+		RetryCodes:  []int{1},
+	}
+
+	for _, dedup := range []bool{false, true} {
+		var opts []ServerOption
+		if dedup {
+			opts = append(opts, WithDeduplication(time.Minute))
+		}
+
+		serverHandler := &FlakyHandler{}
+		rpcServer := NewServer(opts...)
+		rpcServer.Register("FlakyHandler", serverHandler)
+
+		testServ := httptest.NewServer(rpcServer)
+
+		closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "FlakyHandler", []interface{}{&client}, nil, WithRetryPolicy(policy))
+		require.NoError(t, err)
+
+		// methods not tagged with retry are only retried when the call
+		// wasn't processed
+		_, err = client.CallOnce()
+		require.EqualError(t, err, "flaky")
+		require.Equal(t, 1, serverHandler.calls)
+
+		n, err := client.Call()
+		if dedup {
+			// retries got the response of the first call
+			require.EqualError(t, err, "flaky")
+			require.Equal(t, 2, serverHandler.calls)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, 3, n)
+		}
+
+		closer()
+		testServ.Close()
+	}
+
+	// retries tell the server the time left
+	serverHandler := &FlakyHandler{}
+	rpcServer := NewServer()
+	rpcServer.Register("FlakyHandler", serverHandler)
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	policy.MinDelay, policy.MaxDelay = 50*time.Millisecond, 50*time.Millisecond
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "FlakyHandler", []interface{}{&client}, nil, WithRetryPolicy(policy))
+	require.NoError(t, err)
+	defer closer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	require.NoError(t, client.Timed(ctx))
+	require.Len(t, serverHandler.timeouts, 3)
+	for i := 1; i < 3; i++ {
+		require.Less(t, int64(serverHandler.timeouts[i]), int64(serverHandler.timeouts[i-1]-40*time.Millisecond))
+	}
+
+	// idempotency keys are scoped to principals
+	rpcServer = NewServer(
+		WithDeduplication(time.Minute),
+		WithDeduplicationPrincipal(func(ctx context.Context) string {
+			return RequestMeta(ctx)["user"]
+		}))
+	serverHandler = &FlakyHandler{}
+	rpcServer.Register("FlakyHandler", serverHandler)
+	dedupServ := httptest.NewServer(rpcServer)
+	defer dedupServ.Close()
+
+	for _, user := range []string{"alice", "alice", "bob"} {
+		body := `{"jsonrpc":"2.0","id":1,"method":"FlakyHandler.Call","meta":{"idempotency-key":"k","user":"` + user + `"}}`
+		resp, err := http.Post(dedupServ.URL, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+	require.Equal(t, 2, serverHandler.calls)
+}
+
+func TestConnStatus(t *testing.T) {
+	var client struct {
+		AddGet func(int) (int, error)
+	}
+
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	status := &ConnStatus{}
+	changes := status.Subscribe(10)
+
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "SimpleServerHandler", []interface{}{&client}, nil,
+		WithConnStatus(status),
+		WithFailFast(),
+		WithReconnectBackoff(10*time.Millisecond, 20*time.Millisecond),
+		WithReconnectMaxAttempts(3))
+	require.NoError(t, err)
+	defer closer()
+
+	require.Equal(t, StateConnected, status.State())
+	require.Equal(t, StateConnected, (<-changes).State)
+
+	n, err := client.AddGet(1)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, rpcServer.Shutdown(ctx))
+
+	change := <-changes
+	require.Equal(t, StateReconnecting, change.State)
+	require.Error(t, change.Reason)
+
+	_, err = client.AddGet(1)
+	require.True(t, errors.Is(err, ErrDisconnected))
+
+	// reconnects are refused by the closed server
+	change = <-changes
+	require.Equal(t, StateClosed, change.State)
+	require.Contains(t, change.Reason.Error(), "giving up after 3 reconnect attempts")
+
+	_, ok := <-changes
+	require.False(t, ok)
+}
+
+type OfflineHandler struct {
+	lk    sync.Mutex
+	calls []int
+
+	entered chan struct{}
+	block   chan struct{}
+}
+
+func (h *OfflineHandler) Record(n int) []int {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	h.calls = append(h.calls, n)
+	return append([]int{}, h.calls...)
+}
+
+func (h *OfflineHandler) Block(ctx context.Context) error {
+	h.entered <- struct{}{}
+	select {
+	case <-h.block:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestOfflineQueue(t *testing.T) {
+	var client struct {
+		Record   func(context.Context, int) ([]int, error)
+		FailFast func(int) ([]int, error) `alias:"Record" offline:"failfast"`
+		Block    func() error             `offline:"replay"`
+	}
+
+	handler := &OfflineHandler{
+		entered: make(chan struct{}, 2),
+		block:   make(chan struct{}),
+	}
+
+	rpcServer := NewServer()
+	rpcServer.Register("OfflineHandler", handler)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	status := &ConnStatus{}
+	changes := status.Subscribe(10)
+
+	var conn *websocket.Conn
+	reconnect := make(chan struct{})
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "OfflineHandler", []interface{}{&client}, nil,
+		WithConnStatus(status),
+		WithOfflineQueue(3),
+		WithReconnectBackoff(time.Millisecond, time.Millisecond),
+		func(c *Config) {
+			c.proxyConnFactory = func(f func() (*websocket.Conn, error)) func() (*websocket.Conn, error) {
+				return func() (*websocket.Conn, error) {
+					if conn != nil {
+						<-reconnect
+					}
+					c, err := f()
+					conn = c
+					return c, err
+				}
+			}
+		})
+	require.NoError(t, err)
+	defer closer()
+	require.Equal(t, StateConnected, (<-changes).State)
+
+	calls, err := client.Record(context.Background(), 1)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, calls)
+
+	blockErr := make(chan error, 1)
+	go func() {
+		blockErr <- client.Block()
+	}()
+	<-handler.entered
+
+	require.NoError(t, conn.UnderlyingConn().Close())
+	require.Equal(t, StateReconnecting, (<-changes).State)
+
+	_, err = client.FailFast(2)
+	require.True(t, errors.Is(err, ErrDisconnected))
+
+	// calls dropped from the queue when their context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := client.Record(ctx, 2)
+		cancelled <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	require.True(t, errors.Is(<-cancelled, context.Canceled))
+
+	queued := make(chan error, 2)
+	for _, n := range []int{3, 4} {
+		n := n
+		go func() {
+			_, err := client.Record(context.Background(), n)
+			queued <- err
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// the replayed Block call and two Record calls fill the queue
+	_, err = client.Record(context.Background(), 5)
+	require.True(t, errors.Is(err, ErrOfflineQueueFull))
+
+	close(handler.block)
+	reconnect <- struct{}{}
+	require.Equal(t, StateConnected, (<-changes).State)
+
+	require.NoError(t, <-blockErr)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-queued)
+	}
+
+	// cancelled and rejected calls never reached the server
+	handler.lk.Lock()
+	defer handler.lk.Unlock()
+	require.ElementsMatch(t, []int{1, 3, 4}, handler.calls)
+}
+
+type LoadHandler struct {
+	active int64
+}
+
+func (h *LoadHandler) Echo(n int) int {
+	return n
+}
+
+func (h *LoadHandler) Wait(ctx context.Context) error {
+	atomic.AddInt64(&h.active, 1)
+	defer atomic.AddInt64(&h.active, -1)
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (h *LoadHandler) Count(ctx context.Context, n int) (<-chan int, error) {
+	out := make(chan int)
+	go func() {
+		defer close(out)
+		// n < 0 counts until cancelled
+		for i := 0; n < 0 || i < n; i++ {
+			select {
+			case out <- i:
+			case <-ctx.Done():
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return out, nil
+}
+
+type loadClient struct {
+	Echo  func(int) (int, error)
+	Wait  func(context.Context) error
+	Count func(context.Context, int) (<-chan int, error)
+}
+
+// newLoadClient connects to a LoadHandler server; kill closes the current
+// connection, making the client reconnect
+func newLoadClient(t *testing.T, handler *LoadHandler) (client *loadClient, kill func(), closer ClientCloser) {
+	rpcServer := NewServer()
+	rpcServer.Register("LoadHandler", handler)
+
+	testServ := httptest.NewServer(rpcServer)
+	t.Cleanup(testServ.Close)
+
+	var lk sync.Mutex
+	var conn *websocket.Conn
+
+	client = &loadClient{}
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "LoadHandler", []interface{}{client}, nil,
+		WithReconnectBackoff(time.Millisecond, 10*time.Millisecond),
+		func(c *Config) {
+			c.proxyConnFactory = func(f func() (*websocket.Conn, error)) func() (*websocket.Conn, error) {
+				return func() (*websocket.Conn, error) {
+					c, err := f()
+					if err == nil {
+						lk.Lock()
+						conn = c
+						lk.Unlock()
+					}
+					return c, err
+				}
+			}
+		})
+	require.NoError(t, err)
+
+	kill = func() {
+		lk.Lock()
+		defer lk.Unlock()
+		_ = conn.UnderlyingConn().Close()
+	}
+	return client, kill, closer
+}
+
+func isConnClosedErr(err error) bool {
+	var rerr *respError
+	return errors.As(err, &rerr) && rerr.Code == 2
+}
+
+func TestWsReconnectUnderLoad(t *testing.T) {
+	client, kill, closer := newLoadClient(t, &LoadHandler{})
+	defer closer()
+
+	var ok, closed int64
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				n, err := client.Echo(w*1000 + i)
+				switch {
+				case err == nil:
+					assert.Equal(t, w*1000+i, n)
+					atomic.AddInt64(&ok, 1)
+				case isConnClosedErr(err):
+					atomic.AddInt64(&closed, 1)
+				default:
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	for i := 0; i < 5; i++ {
+		time.Sleep(5 * time.Millisecond)
+		kill()
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(8*200), ok+closed)
+	require.Greater(t, ok, int64(0))
+
+	n, err := client.Echo(7)
+	require.NoError(t, err)
+	require.Equal(t, 7, n)
+}
+
+func TestWsConcurrentCancel(t *testing.T) {
+	handler := &LoadHandler{}
+	client, kill, closer := newLoadClient(t, handler)
+	defer closer()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(i%10)*time.Millisecond)
+			defer cancel()
+
+			err := client.Wait(ctx)
+			assert.Error(t, err)
+		}(i)
+
+		if i == 25 {
+			kill()
+		}
+	}
+	wg.Wait()
+
+	// server-side calls were cancelled too
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&handler.active) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	n, err := client.Echo(1)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestWsChannelCloseRace(t *testing.T) {
+	client, kill, closer := newLoadClient(t, &LoadHandler{})
+	defer closer()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var n int
+		switch i % 3 {
+		case 0: // closed by the server
+			n = 10
+		default: // closed by cancelling, or by the connection dropping
+			n = -1
+		}
+
+		ch, err := client.Count(ctx, n)
+		require.NoError(t, err)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for v := range ch {
+				if i%3 == 1 && v == 5 {
+					cancel()
+				}
+			}
+		}(i)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	kill()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("channels weren't closed")
+	}
+}
+
+type RTTHandler struct{}
+
+func (h *RTTHandler) RTT(ctx context.Context) (time.Duration, error) {
+	rtt, _ := ConnRTT(ctx)
+	return rtt, nil
+}
+
+func TestKeepalive(t *testing.T) {
+	var client struct {
+		RTT func() (time.Duration, error)
+	}
+
+	rpcServer := NewServer(WithKeepalive(10*time.Millisecond, 100*time.Millisecond))
+	rpcServer.Register("RTTHandler", &RTTHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	status := &ConnStatus{}
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "RTTHandler", []interface{}{&client}, nil,
+		WithConnStatus(status),
+		WithNativePing(),
+		WithPingInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	defer closer()
+
+	// both sides measure the round-trip time
+	require.Eventually(t, func() bool {
+		return status.RTT() > 0
+	}, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		rtt, err := client.RTT()
+		return err == nil && rtt > 0
+	}, time.Second, 10*time.Millisecond)
+
+	// a peer which never reads doesn't answer pings and gets disconnected
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.Eventually(t, func() bool {
+		return rpcServer.activeConns() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the well-behaved client stays connected
+	require.Equal(t, StateConnected, status.State())
+	_, err = client.RTT()
+	require.NoError(t, err)
+}
+
+type BlobHandler struct{}
+
+func (h *BlobHandler) Blob(n int) string {
+	return strings.Repeat("x", n)
+}
+
+func (h *BlobHandler) Len(s string) int {
+	return len(s)
+}
+
+func TestChunkedMessages(t *testing.T) {
+	type blobClient struct {
+		Blob func(int) (string, error)
+		Len  func(string) (int, error)
+	}
+
+	rpcServer := NewServer(
+		WithServerChunkSize(1<<10),
+		WithMaxRequestSize(1<<20))
+	rpcServer.Register("BlobHandler", &BlobHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+	addr := "ws://" + testServ.Listener.Addr().String()
+
+	var client blobClient
+	closer, err := NewMergeClient(context.Background(), addr, "BlobHandler", []interface{}{&client}, nil,
+		WithChunkSize(1<<10),
+		WithMaxMessageSize(1<<20))
+	require.NoError(t, err)
+	defer closer()
+
+	// large and small calls interleaved on one connection
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		n := 10
+		if i%4 == 0 {
+			n = 256 << 10
+		}
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s, err := client.Blob(n)
+			assert.NoError(t, err)
+			assert.Equal(t, n, len(s))
+		}()
+		go func() {
+			defer wg.Done()
+			l, err := client.Len(strings.Repeat("y", n))
+			assert.NoError(t, err)
+			assert.Equal(t, n, l)
+		}()
+	}
+	wg.Wait()
+
+	// reassembled responses are limited on the client
+	var limited blobClient
+	limitedCloser, err := NewMergeClient(context.Background(), addr, "BlobHandler", []interface{}{&limited}, nil,
+		WithMaxMessageSize(64<<10),
+		WithNoReconnect())
+	require.NoError(t, err)
+	defer limitedCloser()
+
+	_, err = limited.Blob(128 << 10)
+	require.True(t, isConnClosedErr(err), "got %v", err)
+
+	// and requests on the server, chunked or not
+	for _, chunkSize := range []int{1 << 10, 0} {
+		var big blobClient
+		bigCloser, err := NewMergeClient(context.Background(), addr, "BlobHandler", []interface{}{&big}, nil,
+			WithChunkSize(chunkSize),
+			WithNoReconnect())
+		require.NoError(t, err)
+
+		_, err = big.Len(strings.Repeat("z", 2<<20))
+		require.True(t, isConnClosedErr(err), "got %v", err)
+		bigCloser()
+	}
+
+	// many interleaved partial messages, each under the limit, are limited
+	// together
+	conn, _, err := websocket.DefaultDialer.Dial(addr, http.Header{chunkedHeader: []string{"1"}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	chunk := make([]byte, chunkHeaderSize+64<<10)
+send:
+	for i := 0; i < 12; i++ {
+		for id := uint64(0); id < 12; id++ {
+			binary.BigEndian.PutUint64(chunk, id)
+			if err := conn.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
+				break send
+			}
+		}
+	}
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "got %v", err)
+}
+
+type pubSubEvent struct {
+	Kind string
+	N    int
+}
+
+func TestPubSub(t *testing.T) {
+	var client struct {
+		Subscribe       func(ctx context.Context, topic string) (<-chan pubSubEvent, error)               `subscribe:"true"`
+		SubscribeEvents func(ctx context.Context, topic string, filter EventFilter) (<-chan Event, error) `subscribe:"true"`
+	}
+
+	rpcServer := NewServer(WithSubscribeAuth(func(ctx context.Context, topic string) error {
+		if strings.HasPrefix(topic, "secret.") {
+			return errors.New("not allowed")
+		}
+		return nil
+	}))
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	heads, err := client.Subscribe(ctx, "chain.*")
+	require.NoError(t, err)
+	all, err := client.SubscribeEvents(ctx, "chain.>", nil)
+	require.NoError(t, err)
+	filtered, err := client.SubscribeEvents(ctx, "chain.>", EventFilter{"Kind": "b", "N": 2})
+	require.NoError(t, err)
+
+	_, err = client.Subscribe(ctx, "secret.keys")
+	require.EqualError(t, err, "not allowed")
+	_, err = client.Subscribe(ctx, "chain.>.head")
+	require.Error(t, err)
+	require.Error(t, rpcServer.Publish("chain.*", 1))
+
+	require.NoError(t, rpcServer.Publish("chain.head", pubSubEvent{Kind: "a", N: 1}))
+	require.NoError(t, rpcServer.Publish("chain.head.sub", pubSubEvent{Kind: "b", N: 2}))
+	require.NoError(t, rpcServer.Publish("chain.tail", pubSubEvent{Kind: "b", N: 3}))
+	require.NoError(t, rpcServer.Publish("other", pubSubEvent{Kind: "b", N: 2}))
+
+	// single segment wildcard, values unwrapped
+	require.Equal(t, pubSubEvent{Kind: "a", N: 1}, <-heads)
+	require.Equal(t, pubSubEvent{Kind: "b", N: 3}, <-heads)
+
+	// multi segment wildcard, topics preserved
+	var topics []string
+	for i := 0; i < 3; i++ {
+		topics = append(topics, (<-all).Topic)
+	}
+	require.Equal(t, []string{"chain.head", "chain.head.sub", "chain.tail"}, topics)
+
+	ev := <-filtered
+	require.Equal(t, "chain.head.sub", ev.Topic)
+	require.JSONEq(t, `{"Kind":"b","N":2}`, string(ev.Value))
+
+	select {
+	case ev := <-filtered:
+		t.Fatalf("unexpected event on filtered subscription: %v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// cancelling the context closes the channels and unsubscribes on the server
+	cancel()
+	for range heads {
+	}
+	for range all {
+	}
+	for range filtered {
+	}
+
+	require.Eventually(t, func() bool {
+		rpcServer.pubSub.lk.Lock()
+		defer rpcServer.pubSub.lk.Unlock()
+		return len(rpcServer.pubSub.subs) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestChanHTTP(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"sse":      nil,
+		"longpoll": {WithLongPoll()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var client struct {
+				Sub func(context.Context, int, int) (<-chan int, error)
+			}
+
+			serverHandler := &ChanHandler{
+				wait: make(chan struct{}, 10),
+			}
+
+			rpcServer := NewServer()
+			rpcServer.Register("ChanHandler", serverHandler)
+
+			testServ := httptest.NewServer(rpcServer)
+			defer testServ.Close()
+
+			closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "ChanHandler", []interface{}{&client}, nil, opts...)
+			require.NoError(t, err)
+			defer closer()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// closed by the server
+			sub, err := client.Sub(ctx, 2, 6)
+			require.NoError(t, err)
+
+			for i := 0; i < 3; i++ {
+				serverHandler.wait <- struct{}{}
+			}
+			require.Equal(t, 2, <-sub)
+			require.Equal(t, 4, <-sub)
+			_, ok := <-sub
+			require.False(t, ok)
+
+			// closed by the client
+			sub, err = client.Sub(ctx, 1, -1)
+			require.NoError(t, err)
+			ctxdone := serverHandler.ctxdone
+
+			serverHandler.wait <- struct{}{}
+			require.Equal(t, 1, <-sub)
+
+			cancel()
+			select {
+			case <-ctxdone:
+			case <-time.After(time.Second):
+				t.Fatal("server context not cancelled")
+			}
+
+			for range sub {
+			}
+
+			require.Eventually(t, func() bool {
+				rpcServer.longPoll.lk.Lock()
+				defer rpcServer.longPoll.lk.Unlock()
+				return len(rpcServer.longPoll.chans) == 0
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+type ReadOnlyHandler struct {
+	value int32
+}
+
+func (h *ReadOnlyHandler) Get(prefix string, n int) (string, error) {
+	return fmt.Sprintf("%s-%d-%d", prefix, n, atomic.LoadInt32(&h.value)), nil
+}
+
+func (h *ReadOnlyHandler) Fail() error {
+	return errors.New("failed")
+}
+
+func (h *ReadOnlyHandler) Set(v int32) {
+	atomic.StoreInt32(&h.value, v)
+}
+
+func TestHTTPGet(t *testing.T) {
+	serverHandler := &ReadOnlyHandler{}
+
+	rpcServer := NewServer(
+		WithReadOnly("ReadOnly.Get", "public, max-age=60"),
+		WithReadOnly("ReadOnly.Fail", ""))
+	rpcServer.Register("ReadOnly", serverHandler)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	get := func(query string, header http.Header) *http.Response {
+		req, err := http.NewRequest("GET", testServ.URL+"/rpc?"+query, nil)
+		require.NoError(t, err)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+	readResult := func(resp *http.Response) string {
+		defer resp.Body.Close()
+		var res struct {
+			ID     int64
+			Result string
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return res.Result
+	}
+
+	// JSON params
+	resp := get("method=ReadOnly.Get&params="+url.QueryEscape(`["a",1]`), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "public, max-age=60", resp.Header.Get("Cache-Control"))
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+	require.Equal(t, "a-1-0", readResult(resp))
+
+	// base64url params and another id, same result
+	resp = get("method=ReadOnly.Get&id=7&params="+base64.RawURLEncoding.EncodeToString([]byte(`["a",1]`)), nil)
+	require.Equal(t, etag, resp.Header.Get("ETag"))
+	require.Equal(t, "a-1-0", readResult(resp))
+
+	// not modified
+	resp = get("method=ReadOnly.Get&params="+url.QueryEscape(`["a",1]`), http.Header{"If-None-Match": {`"other", ` + etag}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// changed result, new etag
+	serverHandler.Set(1)
+	resp = get("method=ReadOnly.Get&params="+url.QueryEscape(`["a",1]`), http.Header{"If-None-Match": {etag}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEqual(t, etag, resp.Header.Get("ETag"))
+	require.Equal(t, "a-1-1", readResult(resp))
+
+	// errors aren't cached
+	resp = get("method=ReadOnly.Fail", nil)
+	resp.Body.Close()
+	require.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	require.Empty(t, resp.Header.Get("ETag"))
+
+	resp = get("method=ReadOnly.Get&params=%5Bbroken", nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	// only read-only methods can be called with GET
+	resp = get("method=ReadOnly.Set&params="+url.QueryEscape(`[5]`), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	require.EqualValues(t, 1, atomic.LoadInt32(&serverHandler.value))
+
+	// server options apply to handlers registered again in the namespace
+	require.NoError(t, rpcServer.Unregister("ReadOnly"))
+	require.Error(t, rpcServer.Unregister("ReadOnly"))
+	rpcServer.Register("ReadOnly", &ReadOnlyHandler{})
+	resp = get("method=ReadOnly.Get&params="+url.QueryEscape(`["a",1]`), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "public, max-age=60", resp.Header.Get("Cache-Control"))
+	require.Equal(t, "a-1-0", readResult(resp))
+}
+
+type RegisterHandler struct {
+	n int
+}
+
+func (h *RegisterHandler) GetHTTPStatus() (int, error) {
+	return 200 + h.n, nil
+}
+
+func (h *RegisterHandler) Secret() (string, error) {
+	return "s3cr3t", nil
+}
+
+func (h *RegisterHandler) Helper() {}
+
+type BadHandler struct{}
+
+func (h *BadHandler) Bad() (int, int) {
+	return 0, 0
+}
+
+func TestRegisterOptions(t *testing.T) {
+	for name, exp := range map[string][2]string{
+		"GetHTTPStatus": {"getHTTPStatus", "get_http_status"},
+		"HTTPGet":       {"httpGet", "http_get"},
+		"ID":            {"id", "id"},
+		"Version2Info":  {"version2Info", "version2_info"},
+		"Add":           {"add", "add"},
+	} {
+		require.Equal(t, exp[0], LowerCamelCase(name))
+		require.Equal(t, exp[1], SnakeCase(name))
+	}
+
+	rpcServer := NewServer()
+
+	opts := []RegisterOption{
+		WithExcludeMethods("Helper"),
+		WithNameTransform(SnakeCase),
+		WithMethodOptions("Secret", MethodPermission("admin")),
+		WithMethodOptions("GetHTTPStatus", MethodReadOnly("")),
+	}
+	require.NoError(t, rpcServer.TryRegister("Reg", &RegisterHandler{}, opts...))
+
+	// nothing is registered on errors
+	require.Error(t, rpcServer.TryRegister("Reg", &RegisterHandler{}, opts...))
+	require.Error(t, rpcServer.TryRegister("Bad", &BadHandler{}))
+	require.Error(t, rpcServer.TryRegister("Other", &RegisterHandler{}, WithIncludeMethods("Missing")))
+	require.Panics(t, func() {
+		rpcServer.Register("Bad", &BadHandler{})
+	})
+
+	testServ := httptest.NewServer(&auth.Handler{
+		Verify: func(ctx context.Context, token string) ([]auth.Permission, error) {
+			return []auth.Permission{auth.Permission(token)}, nil
+		},
+		Next: rpcServer.ServeHTTP,
+	})
+	defer testServ.Close()
+
+	type regClient struct {
+		GetHTTPStatus func() (int, error)    `alias:"get_http_status"`
+		Secret        func() (string, error) `alias:"secret"`
+		Helper        func() error           `alias:"helper"`
+	}
+	newClient := func(token string) *regClient {
+		var client regClient
+		closer, err := NewClient(context.Background(), testServ.URL, "Reg", &client, http.Header{"Authorization": {"Bearer " + token}})
+		require.NoError(t, err)
+		t.Cleanup(closer)
+		return &client
+	}
+	user, admin := newClient("user"), newClient("admin")
+
+	status, err := user.GetHTTPStatus()
+	require.NoError(t, err)
+	require.Equal(t, 200, status)
+
+	require.Error(t, user.Helper())
+
+	_, err = user.Secret()
+	var respErr *respError
+	require.True(t, errors.As(err, &respErr))
+	require.Equal(t, rpcPermissionDenied, respErr.Code)
+
+	secret, err := admin.Secret()
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t", secret)
+
+	resp, err := http.Get(testServ.URL + "?method=Reg.get_http_status")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+
+	// the built-in namespace stays
+	require.Error(t, rpcServer.Unregister("xrpc"))
+
+	// hot-swap the namespace
+	require.NoError(t, rpcServer.Unregister("Reg"))
+	_, err = user.GetHTTPStatus()
+	require.Error(t, err)
+
+	rpcServer.Register("Reg", &RegisterHandler{n: 1}, opts...)
+	status, err = user.GetHTTPStatus()
+	require.NoError(t, err)
+	require.Equal(t, 201, status)
+}
+
+type sumRequest struct {
+	Values []int
+}
+
+type sumResponse struct {
+	Sum int
+}
+
+func TestRegisterFunc(t *testing.T) {
+	rpcServer := NewServer()
+
+	var calls int32
+	rpcServer.RegisterFunc("Fn.Add", func(ctx context.Context, a, b int) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		return a + b, nil
+	})
+	rpcServer.RegisterTyped("Fn.Sum", func(ctx context.Context, req sumRequest) (sumResponse, error) {
+		var res sumResponse
+		for _, v := range req.Values {
+			res.Sum += v
+		}
+		return res, nil
+	})
+
+	require.Error(t, rpcServer.TryRegisterFunc("Fn.Add", func() {}))
+	require.Error(t, rpcServer.TryRegisterFunc("Fn.NotFunc", 42))
+	require.Error(t, rpcServer.TryRegisterFunc("Fn.Bad", func() (int, int) { return 0, 0 }))
+	require.Error(t, rpcServer.TryRegisterTyped("Fn.Untyped", func(a, b int) (int, error) { return 0, nil }))
+	require.Panics(t, func() {
+		rpcServer.RegisterTyped("Fn.Untyped", func(a, b int) (int, error) { return 0, nil })
+	})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Add func(a, b int) (int, error)
+		Sum func(ctx context.Context, req sumRequest) (sumResponse, error)
+	}
+	closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Fn", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	n, err := client.Add(2, 3)
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	res, err := client.Sum(context.Background(), sumRequest{Values: []int{1, 2, 3}})
+	require.NoError(t, err)
+	require.Equal(t, 6, res.Sum)
+}
+
+type CreateUser struct {
+	Name  string   `json:"name" validate:"required,max=8"`
+	Age   int      `json:"age" validate:"min=18"`
+	Role  string   `json:"role" validate:"oneof=admin user"`
+	Tags  []string `json:"tags" validate:"max=2"`
+	Pets  []Pet    `json:"pets"`
+	Email string   `json:"email"`
+
+	Vets map[string]Pet `json:"vets"`
+}
+
+func (c *CreateUser) Validate() error {
+	if c.Email != "" && !strings.Contains(c.Email, "@") {
+		return ValidationErrors{{Field: "email", Message: "invalid email"}}
+	}
+	return nil
+}
+
+type Pet struct {
+	Kind string `json:"kind" validate:"required"`
+}
+
+// Slug is decoded with a ParamDecoder, which returns values that aren't
+// addressable
+type Slug string
+
+func (s *Slug) Validate() error {
+	if strings.ContainsAny(string(*s), " /") {
+		return errors.New("invalid slug")
+	}
+	return nil
+}
+
+func slugDec(ctx context.Context, rin []byte) (reflect.Value, error) {
+	var s string
+	if err := json.Unmarshal(rin, &s); err != nil {
+		return reflect.Value{}, err
+	}
+	return reflect.ValueOf(Slug(s)), nil
+}
+
+type ValidateHandler struct{}
+
+func (h *ValidateHandler) Create(ctx context.Context, u CreateUser, n int) (string, error) {
+	return u.Name, nil
+}
+
+func (h *ValidateHandler) Rename(ctx context.Context, s Slug) (string, error) {
+	return string(s), nil
+}
+
+func TestParamValidation(t *testing.T) {
+	var client struct {
+		Create func(ctx context.Context, u CreateUser, n int) (string, error)
+		Rename func(ctx context.Context, s Slug) (string, error)
+	}
+
+	rpcServer := NewServer(WithParamValidation(), WithParamDecoder(new(Slug), slugDec))
+	rpcServer.Register("Users", &ValidateHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	for _, proto := range []string{"http://", "ws://"} {
+		closer, err := NewClient(context.Background(), proto+testServ.Listener.Addr().String(), "Users", &client, nil)
+		require.NoError(t, err)
+
+		name, err := client.Create(context.Background(), CreateUser{Name: "bob", Age: 20, Role: "user", Pets: []Pet{{Kind: "cat"}}}, 1)
+		require.NoError(t, err)
+		require.Equal(t, "bob", name)
+
+		_, err = client.Create(context.Background(), CreateUser{
+			Name:  "bartholomew",
+			Age:   12,
+			Role:  "root",
+			Tags:  []string{"a", "b", "c"},
+			Pets:  []Pet{{Kind: "dog"}, {}},
+			Email: "nope",
+			Vets:  map[string]Pet{"b": {}, "a": {Kind: "cat"}, "c": {}},
+		}, 1)
+		require.Error(t, err)
+
+		var respErr *respError
+		require.True(t, errors.As(err, &respErr))
+		require.Equal(t, rpcInvalidParams, respErr.Code)
+
+		require.ElementsMatch(t, []FieldError{
+			{Field: "params[0].email", Message: "invalid email"},
+			{Field: "params[0].name", Message: "length must be at most 8"},
+			{Field: "params[0].age", Message: "value must be at least 18"},
+			{Field: "params[0].role", Message: "must be one of: admin user"},
+			{Field: "params[0].tags", Message: "length must be at most 2"},
+			{Field: "params[0].pets[1].kind", Message: "required"},
+			{Field: "params[0].vets[b].kind", Message: "required"},
+			{Field: "params[0].vets[c].kind", Message: "required"},
+		}, FieldErrors(err))
+
+		// Validate methods with pointer receivers are called for values from
+		// ParamDecoders
+		slug, err := client.Rename(context.Background(), "ok")
+		require.NoError(t, err)
+		require.Equal(t, "ok", slug)
+
+		_, err = client.Rename(context.Background(), "not ok")
+		require.Equal(t, []FieldError{{Field: "params[0]", Message: "invalid slug"}}, FieldErrors(err))
+
+		closer()
+	}
+
+	// validation is opt-in
+	rpcServer = NewServer()
+	rpcServer.Register("Users", &ValidateHandler{})
+	testServ2 := httptest.NewServer(rpcServer)
+	defer testServ2.Close()
+
+	closer, err := NewClient(context.Background(), "ws://"+testServ2.Listener.Addr().String(), "Users", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	_, err = client.Create(context.Background(), CreateUser{Age: 1}, 1)
+	require.NoError(t, err)
+	require.Nil(t, FieldErrors(err))
+}
+
+type StrictParams struct {
+	A int
+}
+
+type BadResult struct {
+	F func()
+}
+
+type StrictHandler struct{}
+
+func (*StrictHandler) Echo(ctx context.Context, p StrictParams) (StrictParams, error) {
+	return p, nil
+}
+
+func (*StrictHandler) TypeOf(ctx context.Context, v interface{}) (string, error) {
+	return fmt.Sprintf("%T", v), nil
+}
+
+func (*StrictHandler) Bad(ctx context.Context) (BadResult, error) {
+	return BadResult{F: func() {}}, nil
+}
+
+func (*StrictHandler) Stuff(ctx context.Context) (UnUnmarshalable, error) {
+	return UnUnmarshalable(5), nil
+}
+
+// StuffChan sends a value which fails to encode between two good ones
+func (*StrictHandler) StuffChan(ctx context.Context) (<-chan UnUnmarshalable, error) {
+	ch := make(chan UnUnmarshalable)
+	go func() {
+		defer close(ch)
+		for _, v := range []UnUnmarshalable{1, -1, 2} {
+			select {
+			case ch <- v:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func TestStrictDecoding(t *testing.T) {
+	var client struct {
+		Echo   func(ctx context.Context, p struct{ A, Extra int }) (StrictParams, error)
+		TypeOf func(ctx context.Context, v interface{}) (string, error)
+		Bad    func(ctx context.Context) (BadResult, error)
+		Stuff  func(ctx context.Context) (UnUnmarshalable, error)
+
+		StuffChan func(ctx context.Context) (<-chan UnUnmarshalable, error)
+	}
+
+	rpcServer := NewServer(
+		WithParamDecoding(StrictDecoding|UseNumber),
+		WithResultEncoder(new(UnUnmarshalable), func(v reflect.Value) (reflect.Value, error) {
+			if v.Int() < 0 {
+				return reflect.Value{}, errors.New("negative stuff")
+			}
+			return reflect.ValueOf(fmt.Sprintf("stuff-%d", v.Int())), nil
+		}),
+	)
+	rpcServer.Register("Strict", &StrictHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	stuffDecoder := WithResultDecoder(new(UnUnmarshalable), func(ctx context.Context, data []byte) (reflect.Value, error) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return reflect.Value{}, err
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(s, "stuff-"))
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(UnUnmarshalable(n)), nil
+	})
+
+	for _, proto := range []string{"http://", "ws://"} {
+		closer, err := NewMergeClient(context.Background(), proto+testServ.Listener.Addr().String(), "Strict", []interface{}{&client}, nil, stuffDecoder)
+		require.NoError(t, err)
+
+		// unknown fields are rejected
+		_, err = client.Echo(context.Background(), struct{ A, Extra int }{A: 1, Extra: 2})
+		var respErr *respError
+		require.True(t, errors.As(err, &respErr))
+		require.Equal(t, rpcParseError, respErr.Code)
+		require.Contains(t, err.Error(), "unknown field")
+
+		// numbers stay json.Number
+		typ, err := client.TypeOf(context.Background(), 12345678901234567)
+		require.NoError(t, err)
+		require.Equal(t, "json.Number", typ)
+
+		// results which can't be marshaled are reported as internal errors
+		_, err = client.Bad(context.Background())
+		require.True(t, errors.As(err, &respErr))
+		require.Equal(t, rpcInternalError, respErr.Code)
+		require.Contains(t, err.Error(), "encoding result")
+
+		// encoded and decoded with custom functions
+		stuff, err := client.Stuff(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, UnUnmarshalable(5), stuff)
+
+		// channels are closed at values which fail to encode
+		ch, err := client.StuffChan(context.Background())
+		require.NoError(t, err)
+		var vals []UnUnmarshalable
+		for v := range ch {
+			vals = append(vals, v)
+		}
+		require.Equal(t, []UnUnmarshalable{1}, vals)
+
+		closer()
+	}
+
+	// with the error
+	req, err := http.NewRequest("POST", testServ.URL, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"Strict.StuffChan","params":[]}`))
+	require.NoError(t, err)
+	req.Header.Set("Accept", eventStreamType)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Contains(t, string(body), `"method":"xrpc.ch.close","params":[1,"encoding channel value: negative stuff"]`)
+
+	// trailing data after the request is rejected
+	resp, err = http.Post(testServ.URL, "application/json",
+		strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"Strict.TypeOf","params":[1]} {}`))
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Contains(t, string(body), "-32700")
+	require.Contains(t, string(body), "unexpected data after top-level value")
+}
+
+type PanicValue int
+
+func (v PanicValue) MarshalJSON() ([]byte, error) {
+	if v < 0 {
+		panic("negative value")
+	}
+	return json.Marshal(int(v))
+}
+
+type PanickingHandler struct {
+	// stopped gets a value when Values stops sending, as its context is
+	// cancelled
+	stopped chan struct{}
+}
+
+func (*PanickingHandler) Boom(ctx context.Context) (int, error) {
+	panic("boom")
+}
+
+type PanicParams struct {
+	Pet *Pet
+}
+
+// Validate panics when Pet isn't set
+func (p PanicParams) Validate() error {
+	if p.Pet.Kind == "" {
+		return errors.New("no kind")
+	}
+	return nil
+}
+
+func (*PanickingHandler) Check(ctx context.Context, p PanicParams) error {
+	return nil
+}
+
+func (h *PanickingHandler) Values(ctx context.Context) (<-chan PanicValue, error) {
+	ch := make(chan PanicValue)
+	go func() {
+		defer close(ch)
+		for _, v := range []PanicValue{1, -1, 2} {
+			select {
+			case ch <- v:
+			case <-ctx.Done():
+				h.stopped <- struct{}{}
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func TestPanicHandler(t *testing.T) {
+	var client struct {
+		Boom   func(ctx context.Context) (int, error)
+		Values func(ctx context.Context) (<-chan int, error)
+		Check  func(ctx context.Context, p PanicParams) error
+	}
+
+	var lk sync.Mutex
+	var panics []*PanicError
+
+	rpcServer := NewServer(WithParamValidation(), WithPanicHandler(func(ctx context.Context, p *PanicError) {
+		lk.Lock()
+		defer lk.Unlock()
+		panics = append(panics, p)
+	}))
+	handler := &PanickingHandler{stopped: make(chan struct{}, 1)}
+	rpcServer.Register("Panic", handler)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Panic", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	_, err = client.Boom(context.Background())
+	require.True(t, IsPanic(err))
+	require.Contains(t, err.Error(), "panic in rpc method 'Panic.Boom': boom")
+
+	// the channel is closed after the value which panicked, and the method
+	// stops sending
+	checkValues := func(ch <-chan int, err error) {
+		require.NoError(t, err)
+		var vals []int
+		for v := range ch {
+			vals = append(vals, v)
+		}
+		require.Equal(t, []int{1}, vals)
+
+		select {
+		case <-handler.stopped:
+		case <-time.After(time.Second):
+			t.Fatal("method context not cancelled")
+		}
+	}
+	checkValues(client.Values(context.Background()))
+
+	// the connection still works
+	_, err = client.Boom(context.Background())
+	require.True(t, IsPanic(err))
+
+	// the same over HTTP
+	for name, opts := range map[string][]Option{
+		"sse":      nil,
+		"longpoll": {WithLongPoll()},
+	} {
+		var httpClient struct {
+			Values func(ctx context.Context) (<-chan int, error)
+		}
+		httpCloser, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "Panic", []interface{}{&httpClient}, nil, opts...)
+		require.NoError(t, err, name)
+		checkValues(httpClient.Values(context.Background()))
+		httpCloser()
+	}
+
+	// panics in Validate methods are recovered too
+	err = client.Check(context.Background(), PanicParams{})
+	require.True(t, IsPanic(err))
+	require.Contains(t, err.Error(), "validating params for 'Panic.Check'")
+	require.NoError(t, client.Check(context.Background(), PanicParams{Pet: &Pet{Kind: "cat"}}))
+
+	lk.Lock()
+	require.Len(t, panics, 6)
+	require.Equal(t, "Panic.Boom", panics[0].Method)
+	require.Equal(t, "boom", panics[0].Value)
+	require.Contains(t, string(panics[0].Stack), "(*PanickingHandler).Boom")
+	for _, i := range []int{1, 3, 4} {
+		require.Equal(t, "Panic.Values", panics[i].Method)
+	}
+	require.Equal(t, "Panic.Check", panics[5].Method)
+	lk.Unlock()
+
+	// panic values aren't sent to clients
+	rpcServer = NewServer(WithPanicDetail(false))
+	rpcServer.Register("Panic", &PanickingHandler{})
+	testServ2 := httptest.NewServer(rpcServer)
+	defer testServ2.Close()
+
+	closer2, err := NewClient(context.Background(), "http://"+testServ2.Listener.Addr().String(), "Panic", &client, nil)
+	require.NoError(t, err)
+	defer closer2()
+
+	_, err = client.Boom(context.Background())
+	require.True(t, IsPanic(err))
+	require.NotContains(t, err.Error(), "boom")
+	require.False(t, IsPanic(errors.New("boom")))
+}
+
+type RecordItem struct {
+	Name  string
+	Count int
+}
+
+type RecordHandler struct {
+	offset int
+}
+
+func (h *RecordHandler) Add(ctx context.Context, a, b int) (int, error) {
+	return a + b + h.offset, nil
+}
+
+func (h *RecordHandler) Items(ctx context.Context, n int) ([]RecordItem, error) {
+	items := make([]RecordItem, n)
+	for i := range items {
+		items[i] = RecordItem{Name: fmt.Sprint("item", i), Count: i + h.offset}
+	}
+	return items, nil
+}
+
+func (h *RecordHandler) Fail(ctx context.Context) error {
+	return fmt.Errorf("failed %d", h.offset)
+}
+
+func TestRecordReplay(t *testing.T) {
+	var client struct {
+		Add   func(ctx context.Context, a, b int) (int, error)
+		Items func(ctx context.Context, n int) ([]RecordItem, error)
+		Fail  func(ctx context.Context) error
+	}
+
+	var recordings bytes.Buffer
+	rpcServer := NewServer(WithRecording(&recordings, RecordConfig{
+		Methods: []string{"Record.Add", "Record.Items", "Record.Fail"},
+		Principal: func(ctx context.Context) string {
+			return RequestMeta(ctx)["user"]
+		},
+		Principals: []string{"alice"},
+	}))
+	rpcServer.Register("Record", &RecordHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Record", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	alice, cancel := context.WithTimeout(WithMeta(context.Background(), "user", "alice"), time.Minute)
+	defer cancel()
+	bob := WithMeta(context.Background(), "user", "bob")
+
+	n, err := client.Add(alice, 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	_, err = client.Add(bob, 3, 4) // not recorded
+	require.NoError(t, err)
+	_, err = client.Items(alice, 2)
+	require.NoError(t, err)
+	require.Error(t, client.Fail(alice))
+
+	lines := strings.Split(strings.TrimSpace(recordings.String()), "\n")
+	require.Len(t, lines, 3)
+
+	var rec Recording
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &rec))
+	require.Equal(t, "Record.Add", rec.Method)
+	require.Equal(t, "alice", rec.Principal)
+	// metadata of the call itself isn't recorded
+	require.Equal(t, Meta{"user": "alice"}, rec.Meta)
+	require.Equal(t, []json.RawMessage{json.RawMessage("1"), json.RawMessage("2")}, rec.Params)
+	require.Equal(t, json.RawMessage("3"), rec.Result)
+	require.NotZero(t, rec.Duration)
+
+	// replaying against the same handler matches
+	results, err := Replay(context.Background(), rpcServer, bytes.NewReader(recordings.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	for _, r := range results {
+		require.Empty(t, r.Diffs, r.Recording.Method)
+	}
+
+	// a changed handler, on a remote server
+	changed := NewServer()
+	changed.Register("Record", &RecordHandler{offset: 1})
+	changedServ := httptest.NewTLSServer(changed)
+	defer changedServ.Close()
+
+	results, err = ReplayHTTP(context.Background(), changedServ.Client(), changedServ.URL, nil, bytes.NewReader(recordings.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	require.Equal(t, []string{"result: 3 != 4"}, results[0].Diffs)
+	require.Equal(t, []string{"result[0].Count: 0 != 1", "result[1].Count: 1 != 2"}, results[1].Diffs)
+	require.Equal(t, []string{`error: (1) "failed 0" != (1) "failed 1"`}, results[2].Diffs)
+
+	// idempotency keys aren't replayed, so servers deduplicating calls don't
+	// return stored responses
+	rec.Meta[metaIdempotencyKey] = "k"
+	withKey, err := json.Marshal(rec)
+	require.NoError(t, err)
+
+	dedupServer := NewServer(WithDeduplication(time.Minute))
+	dedupServer.Register("Record", &RecordHandler{})
+	results, err = Replay(context.Background(), dedupServer, bytes.NewReader(withKey))
+	require.NoError(t, err)
+	require.Empty(t, results[0].Diffs)
+
+	require.NoError(t, dedupServer.Unregister("Record"))
+	dedupServer.Register("Record", &RecordHandler{offset: 1})
+	results, err = Replay(context.Background(), dedupServer, bytes.NewReader(withKey))
+	require.NoError(t, err)
+	require.Equal(t, []string{"result: 3 != 4"}, results[0].Diffs)
+
+	// calls don't wait for a slow writer of recordings
+	slow := &blockingWriter{started: make(chan struct{}), release: make(chan struct{})}
+	slowServer := NewServer(WithRecording(slow, RecordConfig{}))
+	slowServer.Register("Record", &RecordHandler{})
+	slowServ := httptest.NewServer(slowServer)
+	defer slowServ.Close()
+
+	slowCloser, err := NewClient(context.Background(), "ws://"+slowServ.Listener.Addr().String(), "Record", &client, nil)
+	require.NoError(t, err)
+	defer slowCloser()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := client.Add(context.Background(), 1, 2)
+		assert.NoError(t, err)
+	}()
+	<-slow.started
+
+	n, err = client.Add(context.Background(), 3, 4)
+	require.NoError(t, err)
+	require.Equal(t, 7, n)
+
+	close(slow.release)
+	<-done
+	require.Equal(t, 2, strings.Count(slow.String(), "\n"))
+}
+
+// blockingWriter blocks the first write until release is closed
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+	first   int32
+
+	lk  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	if atomic.CompareAndSwapInt32(&w.first, 0, 1) {
+		close(w.started)
+		<-w.release
+	}
+
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *blockingWriter) String() string {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	return w.buf.String()
+}
+
+func TestHTTPStream(t *testing.T) {
+	connViews := []*view.View{metrics.RPCWebsocketConnectionsView, metrics.RPCStreamConnectionsView}
+	require.NoError(t, view.Register(connViews...))
+	defer view.Unregister(connViews...)
+
+	chanHandler := &ChanHandler{
+		wait: make(chan struct{}, 5),
+	}
+	ctxHandler := &CtxHandler{}
+
+	rpcServer := NewServer()
+	rpcServer.Register("ChanHandler", chanHandler)
+	rpcServer.Register("CtxHandler", ctxHandler)
+
+	testServ := httptest.NewUnstartedServer(rpcServer)
+	testServ.EnableHTTP2 = true
+	testServ.StartTLS()
+	defer testServ.Close()
+
+	var client struct {
+		Sub  func(context.Context, int, int) (<-chan int, error)
+		Test func(ctx context.Context)
+	}
+	closer, err := NewMergeClient(context.Background(), testServ.URL, "ChanHandler", []interface{}{&client}, nil,
+		WithHTTPStream(), WithHTTPClient(testServ.Client()))
+	require.NoError(t, err)
+	defer closer()
+
+	// channels
+	chanHandler.wait <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := client.Sub(ctx, 2, -1)
+	require.NoError(t, err)
+	require.Equal(t, 2, <-sub)
+
+	chanHandler.wait <- struct{}{}
+	chanHandler.wait <- struct{}{}
+	require.Equal(t, 4, <-sub)
+	require.Equal(t, 6, <-sub)
+
+	cancel()
+	_, ok := <-sub
+	require.False(t, ok)
+
+	// cancellation
+	var ctxClient struct {
+		Test func(ctx context.Context)
+	}
+	ctxCloser, err := NewMergeClient(context.Background(), testServ.URL, "CtxHandler", []interface{}{&ctxClient}, nil,
+		WithHTTPStream(), WithHTTPClient(testServ.Client()))
+	require.NoError(t, err)
+	defer ctxCloser()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ctxClient.Test(ctx)
+
+	ctxHandler.lk.Lock()
+	require.True(t, ctxHandler.cancelled)
+	ctxHandler.lk.Unlock()
+
+	// streams aren't counted as websocket connections
+	conns := map[string]float64{}
+	for _, v := range connViews {
+		rows, err := view.RetrieveData(v.Name)
+		require.NoError(t, err)
+		for _, r := range rows {
+			conns[v.Name] += r.Data.(*view.SumData).Value
+		}
+	}
+	// websocket connections of other tests may still be closing
+	require.LessOrEqual(t, conns[metrics.RPCWebsocketConnectionsView.Name], float64(0))
+	require.Equal(t, float64(2), conns[metrics.RPCStreamConnectionsView.Name])
+
+	// streams need HTTP/2
+	h1Serv := httptest.NewServer(rpcServer)
+	defer h1Serv.Close()
+
+	_, err = NewMergeClient(context.Background(), h1Serv.URL, "ChanHandler", []interface{}{&client}, nil, WithHTTPStream())
+	require.Error(t, err)
+	var serr *errHTTPStatus
+	require.True(t, errors.As(err, &serr))
+	require.Equal(t, http.StatusHTTPVersionNotSupported, serr.code)
+}
+
+func TestHTTPStreamReconnect(t *testing.T) {
+	rpcServer := NewServer()
+	serverHandler := &SimpleServerHandler{}
+	rpcServer.Register("SimpleServerHandler", serverHandler)
+
+	testServ := httptest.NewUnstartedServer(rpcServer)
+	testServ.EnableHTTP2 = true
+	testServ.StartTLS()
+	defer testServ.Close()
+
+	status := &ConnStatus{}
+	var client struct {
+		Add func(int) error
+	}
+	closer, err := NewMergeClient(context.Background(), testServ.URL, "SimpleServerHandler", []interface{}{&client}, nil,
+		WithHTTPStream(), WithHTTPClient(testServ.Client()), WithConnStatus(status), WithReconnectBackoff(10*time.Millisecond, 10*time.Millisecond))
+	require.NoError(t, err)
+	defer closer()
+
+	require.NoError(t, client.Add(2))
+	changes := status.Subscribe(10)
+
+	// drop the stream, the client opens a new one
+	testServ.CloseClientConnections()
+	require.Equal(t, StateReconnecting, (<-changes).State)
+	require.Equal(t, StateConnected, (<-changes).State)
+	require.NoError(t, client.Add(3))
+
+	require.Equal(t, 5, serverHandler.n)
+}
+
+func TestGateway(t *testing.T) {
+	// a websocket backend and an HTTP one
+	chanHandler := &ChanHandler{
+		wait: make(chan struct{}, 5),
+	}
+	wsBackend := NewServer()
+	wsBackend.Register("ChanHandler", chanHandler)
+	wsBackend.Register("MetaHandler", &MetaHandler{})
+	wsServ := httptest.NewServer(wsBackend)
+	defer wsServ.Close()
+
+	ctxHandler := &CtxHandler{}
+	httpBackend := NewServer()
+	httpBackend.Register("CtxHandler", ctxHandler)
+	httpBackend.Register("SimpleServerHandler", &SimpleServerHandler{})
+	httpServ := httptest.NewServer(httpBackend)
+	defer httpServ.Close()
+
+	gw, err := NewGateway(GatewayConfig{
+		Routes: []GatewayRoute{{
+			Namespace: "ChanHandler",
+			Addrs:     []string{"ws://" + wsServ.Listener.Addr().String()},
+			Channels:  []string{"ChanHandler.Sub"},
+		}, {
+			Namespace: "MetaHandler",
+			Addrs:     []string{"ws://" + wsServ.Listener.Addr().String()},
+			Conns:     2,
+		}, {
+			Namespace: "CtxHandler",
+			Addrs:     []string{httpServ.URL},
+		}, {
+			Namespace: "SimpleServerHandler",
+			Addrs:     []string{httpServ.URL},
+			Perm:      "admin",
+		}},
+		Verify: func(ctx context.Context, token string) ([]auth.Permission, error) {
+			if token != "secret" {
+				return nil, errors.New("bad token")
+			}
+			return []auth.Permission{"admin"}, nil
+		},
+	})
+	require.NoError(t, err)
+	defer gw.Close()
+	gw.Register("Local", &SimpleServerHandler{})
+
+	gwServ := httptest.NewServer(gw)
+	defer gwServ.Close()
+	gwAddr := "ws://" + gwServ.Listener.Addr().String()
+
+	// channels
+	var chanClient struct {
+		Sub func(context.Context, int, int) (<-chan int, error)
+	}
+	closer, err := NewClient(context.Background(), gwAddr, "ChanHandler", &chanClient, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	chanHandler.wait <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := chanClient.Sub(ctx, 2, -1)
+	require.NoError(t, err)
+	require.Equal(t, 2, <-sub)
+	chanHandler.wait <- struct{}{}
+	require.Equal(t, 4, <-sub)
+	cancel()
+	_, ok := <-sub
+	require.False(t, ok)
+
+	// metadata, over both backend connections
+	var metaClient struct {
+		Tenant func(context.Context) (string, error)
+	}
+	closer, err = NewClient(context.Background(), gwAddr, "MetaHandler", &metaClient, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	for i := 0; i < 2; i++ {
+		respMeta := Meta{}
+		ctx := WithResponseMeta(WithMeta(context.Background(), "tenant", "t-1"), respMeta)
+		tenant, err := metaClient.Tenant(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "t-1", tenant)
+		require.Equal(t, "r-1", respMeta["request-id"])
+	}
+
+	// cancellation, through an HTTP backend
+	var ctxClient struct {
+		Test func(ctx context.Context)
+	}
+	closer, err = NewClient(context.Background(), gwAddr, "CtxHandler", &ctxClient, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ctxClient.Test(ctx)
+	require.Eventually(t, func() bool {
+		ctxHandler.lk.Lock()
+		defer ctxHandler.lk.Unlock()
+		return ctxHandler.cancelled
+	}, time.Second, 10*time.Millisecond)
+
+	// permissions are checked by the gateway
+	var simpleClient struct {
+		AddGet  func(int) (int, error)
+		Missing func() error
+	}
+	closer, err = NewClient(context.Background(), gwAddr, "SimpleServerHandler", &simpleClient, nil)
+	require.NoError(t, err)
+	_, err = simpleClient.AddGet(1)
+	require.Error(t, err)
+	require.Equal(t, rpcPermissionDenied, err.(*respError).Code)
+	closer()
+
+	closer, err = NewClient(context.Background(), gwAddr, "SimpleServerHandler", &simpleClient, http.Header{"Authorization": []string{"Bearer secret"}})
+	require.NoError(t, err)
+	defer closer()
+	n, err := simpleClient.AddGet(3)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	// errors of backends keep their code
+	err = simpleClient.Missing()
+	require.Error(t, err)
+	require.Equal(t, rpcMethodNotFound, err.(*respError).Code)
+
+	// methods of the gateway itself, and methods nobody serves
+	var localClient struct {
+		AddGet func(int) (int, error)
+	}
+	closer, err = NewClient(context.Background(), gwAddr, "Local", &localClient, nil)
+	require.NoError(t, err)
+	defer closer()
+	n, err = localClient.AddGet(5)
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+
+	closer, err = NewClient(context.Background(), gwAddr, "Unrouted", &localClient, nil)
+	require.NoError(t, err)
+	defer closer()
+	_, err = localClient.AddGet(5)
+	require.Error(t, err)
+	require.Equal(t, rpcMethodNotFound, err.(*respError).Code)
+}
+
+type CacheHandler struct {
+	lk    sync.Mutex
+	calls map[string]int
+
+	release chan struct{}
+	wait    chan struct{}
+}
+
+type CacheQuery struct {
+	A int
+	B string
+}
+
+func (h *CacheHandler) count(method string) int {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	if h.calls == nil {
+		h.calls = map[string]int{}
+	}
+	h.calls[method]++
+	return h.calls[method]
+}
+
+func (h *CacheHandler) Get(ctx context.Context, q CacheQuery) (int, error) {
+	if q.A < 0 {
+		return h.count("Get"), errors.New("negative")
+	}
+	SetResponseMeta(ctx, "user", RequestMeta(ctx)["user"])
+	return h.count("Get"), nil
+}
+
+func (h *CacheHandler) Wait(ctx context.Context) (int, error) {
+	select {
+	case <-h.wait:
+		return h.count("Wait"), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (h *CacheHandler) Slow(ctx context.Context) int {
+	<-h.release
+	return h.count("Slow")
+}
+
+func (h *CacheHandler) Mine(ctx context.Context) int {
+	return h.count("Mine")
+}
+
+func TestMethodCache(t *testing.T) {
+	views := []*view.View{metrics.RPCCacheHitsView, metrics.RPCCacheMissesView, metrics.RPCRequestsInFlightView}
+	require.NoError(t, view.Register(views...))
+	defer view.Unregister(views...)
+
+	handler := &CacheHandler{release: make(chan struct{}), wait: make(chan struct{})}
+
+	rpcServer := NewServer(
+		WithMethodCache("CacheHandler.Slow", CacheConfig{}),
+		WithMethodCache("CacheHandler.Wait", CacheConfig{}),
+		WithMethodCache("CacheHandler.Mine", CacheConfig{
+			Principal: func(ctx context.Context) string {
+				return RequestMeta(ctx)["user"]
+			},
+		}),
+	)
+	rpcServer.Register("CacheHandler", handler,
+		WithMethodOptions("Get", MethodCache(CacheConfig{MaxEntries: 2})))
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Get  func(context.Context, CacheQuery) (int, error)
+		Slow func(context.Context) (int, error)
+		Wait func(context.Context) (int, error)
+		Mine func(context.Context) (int, error)
+	}
+	closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "CacheHandler", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	ctx := context.Background()
+	get := func(q CacheQuery) int {
+		n, err := client.Get(ctx, q)
+		require.NoError(t, err)
+		return n
+	}
+
+	require.Equal(t, 1, get(CacheQuery{A: 1, B: "x"}))
+	require.Equal(t, 1, get(CacheQuery{A: 1, B: "x"}))
+
+	// params are compared as JSON values
+	body := `{"jsonrpc":"2.0","id":1,"method":"CacheHandler.Get","params":[{ "B": "x", "A": 1 }]}`
+	resp, err := http.Post(testServ.URL, "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Contains(t, string(out), `"result":1`)
+
+	// least recently used responses are dropped
+	require.Equal(t, 2, get(CacheQuery{A: 2}))
+	require.Equal(t, 3, get(CacheQuery{A: 3}))
+	require.Equal(t, 3, get(CacheQuery{A: 3}))
+	require.Equal(t, 4, get(CacheQuery{A: 1, B: "x"}))
+
+	// errors aren't cached
+	_, err = client.Get(ctx, CacheQuery{A: -1})
+	require.Error(t, err)
+	_, err = client.Get(ctx, CacheQuery{A: -1})
+	require.Error(t, err)
+	require.Equal(t, 7, get(CacheQuery{A: 7}))
+
+	// invalidation
+	rpcServer.InvalidateCache("CacheHandler.Get")
+	require.Equal(t, 8, get(CacheQuery{A: 7}))
+	rpcServer.InvalidateCachePrefix("CacheHandler.")
+	require.Equal(t, 9, get(CacheQuery{A: 7}))
+	require.Equal(t, 9, get(CacheQuery{A: 7}))
+
+	// response metadata isn't replayed to other callers
+	aliceMeta, bobMeta := Meta{}, Meta{}
+	n, err := client.Get(WithResponseMeta(WithMeta(ctx, "user", "alice"), aliceMeta), CacheQuery{A: 10})
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+	require.Equal(t, "alice", aliceMeta["user"])
+	n, err = client.Get(WithResponseMeta(WithMeta(ctx, "user", "bob"), bobMeta), CacheQuery{A: 10})
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+	require.Empty(t, bobMeta)
+
+	inFlight := func(method string, n float64) {
+		require.Eventually(t, func() bool {
+			rows, err := view.RetrieveData(metrics.RPCRequestsInFlightView.Name)
+			require.NoError(t, err)
+			for _, r := range rows {
+				if r.Tags[0].Value == method {
+					return r.Data.(*view.SumData).Value == n
+				}
+			}
+			return false
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// concurrent calls share one execution
+	var wg sync.WaitGroup
+	results := make([]int, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n, err := client.Slow(ctx)
+			require.NoError(t, err)
+			results[i] = n
+		}(i)
+	}
+	inFlight("CacheHandler.Slow", 5)
+	close(handler.release)
+	wg.Wait()
+	require.Equal(t, []int{1, 1, 1, 1, 1}, results)
+
+	// a call cancelled by its client doesn't fail the calls waiting for it
+	cctx, cancel := context.WithCancel(ctx)
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := client.Wait(cctx)
+		cancelled <- err
+	}()
+	inFlight("CacheHandler.Wait", 1)
+	waiting := make(chan int, 1)
+	go func() {
+		n, err := client.Wait(ctx)
+		assert.NoError(t, err)
+		waiting <- n
+	}()
+	inFlight("CacheHandler.Wait", 2)
+	cancel()
+	require.Error(t, <-cancelled)
+	close(handler.wait)
+	require.Equal(t, 1, <-waiting)
+
+	// responses are cached for each principal
+	alice := WithMeta(ctx, "user", "alice")
+	bob := WithMeta(ctx, "user", "bob")
+	for _, c := range []struct {
+		ctx context.Context
+		n   int
+	}{{alice, 1}, {bob, 2}, {alice, 1}, {bob, 2}} {
+		n, err := client.Mine(c.ctx)
+		require.NoError(t, err)
+		require.Equal(t, c.n, n)
+	}
+
+	// hits and misses are recorded
+	counts := map[string]int64{}
+	for _, v := range []*view.View{metrics.RPCCacheHitsView, metrics.RPCCacheMissesView} {
+		rows, err := view.RetrieveData(v.Name)
+		require.NoError(t, err)
+		for _, r := range rows {
+			if r.Tags[0].Value == "CacheHandler.Get" {
+				counts[v.Name] = r.Data.(*view.CountData).Value
+			}
+		}
+	}
+	require.Equal(t, int64(5), counts[metrics.RPCCacheHitsView.Name])
+	require.Equal(t, int64(10), counts[metrics.RPCCacheMissesView.Name])
+
+	// handlers registered again don't get responses of the old ones
+	require.NoError(t, rpcServer.Unregister("CacheHandler"))
+	rpcServer.Register("CacheHandler", &CacheHandler{
+		calls:   map[string]int{"Slow": 10},
+		release: handler.release,
+	})
+	n, err = client.Slow(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 11, n)
+
+	// and their responses are cached like before
+	n, err = client.Slow(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 11, n)
+}
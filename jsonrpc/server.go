@@ -2,30 +2,90 @@ package jsonrpc
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
+	"gitee.com/huanghua_2017/hggutils/jsonrpc/metrics"
 	"github.com/gorilla/websocket"
+	"go.opencensus.io/stats"
+	"golang.org/x/xerrors"
 )
 
 const (
 	rpcParseError     = -32700
 	rpcMethodNotFound = -32601
 	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+
+	// implementation-defined server errors
+	rpcTimeout          = -32001
+	rpcShuttingDown     = -32002
+	rpcPermissionDenied = -32003
+	rpcPanic            = -32004
 )
 
+// builtinNamespace holds methods of the server itself, like pub/sub and
+// long-polling
+const builtinNamespace = "xrpc"
+
 // RPCServer provides a jsonrpc 2.0 http server handler
 type RPCServer struct {
-	methods map[string]rpcHandler
+	// methodsLk guards methods and aliasedMethods, which can change while
+	// serving
+	methodsLk sync.RWMutex
+	methods   map[string]rpcHandler
 
 	// aliasedMethods contains a map of alias:original method names.
 	// These are used as fallbacks if a method is not found by the given method name.
 	aliasedMethods map[string]string
 
-	paramDecoders map[reflect.Type]ParamDecoder
+	paramDecoders  map[reflect.Type]ParamDecoder
+	decodeFlags    DecodeFlags
+	validateParams bool
+	resultEncoders map[reflect.Type]ResultEncoder
 
 	maxRequestSize int64
+	chunkSize      int
+
+	defaultTimeout time.Duration
+	maxTimeout     time.Duration
+	methodTimeouts map[string]methodTimeout
+
+	// readOnly holds methods callable with GET, with their Cache-Control
+	readOnly map[string]string
+
+	dedup *dedupCache
+	// caches are response caches set with WithMethodCache
+	caches map[string]*methodCache
+
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+
+	panicHandler    PanicHandler
+	hidePanicDetail bool
+	crashOnPanic    bool
+
+	recorder *recorder
+
+	// forward makes handlers for methods which aren't registered, see Gateway
+	forward func(method string, nParams int) (rpcHandler, bool)
+
+	pubSub   *pubSub
+	longPoll *longPoll
+
+	// graceful shutdown state
+	shutdownLk    sync.Mutex
+	closing       bool
+	calls         map[uint64]context.CancelFunc
+	callCtr       uint64
+	conns         map[*wsConn]struct{}
+	goAway        chan struct{}
+	stopConns     chan struct{}
+	stopConnsOnce sync.Once
 }
 
 // NewServer creates new RPCServer instance
@@ -35,12 +95,53 @@ func NewServer(opts ...ServerOption) *RPCServer {
 		o(&config)
 	}
 
-	return &RPCServer{
+	var dedup *dedupCache
+	if config.dedupWindow > 0 {
+		dedup = newDedupCache(config.dedupWindow, config.dedupPrincipal)
+	}
+
+	caches := map[string]*methodCache{}
+	for method, cc := range config.methodCaches {
+		caches[method] = newMethodCache(cc)
+	}
+
+	s := &RPCServer{
 		methods:        map[string]rpcHandler{},
 		aliasedMethods: map[string]string{},
 		paramDecoders:  config.paramDecoders,
+		decodeFlags:    config.decodeFlags,
+		validateParams: config.validateParams,
+		resultEncoders: config.resultEncoders,
 		maxRequestSize: config.maxRequestSize,
+		chunkSize:      config.chunkSize,
+		defaultTimeout: config.defaultTimeout,
+		maxTimeout:     config.maxTimeout,
+		methodTimeouts: config.methodTimeouts,
+		readOnly:       config.readOnly,
+		dedup:          dedup,
+		caches:         caches,
+
+		keepaliveInterval: config.keepaliveInterval,
+		keepaliveTimeout:  config.keepaliveTimeout,
+
+		panicHandler:    config.panicHandler,
+		hidePanicDetail: config.hidePanicDetail,
+		crashOnPanic:    config.crashOnPanic,
+
+		recorder: config.recorder,
+
+		pubSub: newPubSub(config.subscribeAuth),
+
+		calls:     map[uint64]context.CancelFunc{},
+		conns:     map[*wsConn]struct{}{},
+		goAway:    make(chan struct{}),
+		stopConns: make(chan struct{}),
 	}
+	s.longPoll = newLongPoll(s)
+	s.Register(builtinNamespace, s.pubSub)
+	s.Register(builtinNamespace, s.longPoll)
+
+	return s
 }
 
 var upgrader = websocket.Upgrader{
@@ -57,37 +158,94 @@ func (s *RPCServer) handleWS(ctx context.Context, w http.ResponseWriter, r *http
 		w.Header().Set("Sec-WebSocket-Protocol", r.Header.Get("Sec-WebSocket-Protocol"))
 	}
 
-	c, err := upgrader.Upgrade(w, r, nil)
+	// tell the client we accept chunked messages
+	c, err := upgrader.Upgrade(w, r, http.Header{chunkedHeader: []string{"1"}})
 	if err != nil {
 		log.Error(err)
 		w.WriteHeader(500)
 		return
 	}
 
-	(&wsConn{
+	clientChunked := r.Header.Get(chunkedHeader) != ""
+	s.serveConn(ctx, c, metrics.RPCWebsocketConnections, true, clientChunked)
+}
+
+// serveConn runs a connection from a client, websocket or HTTP/2 stream, until
+// it's closed. conns counts the open connections of the kind.
+func (s *RPCServer) serveConn(ctx context.Context, c msgConn, conns *stats.Int64Measure, nativePing bool, clientChunked bool) {
+	wc := &wsConn{
 		conn:        c,
 		noReConnect: true,
 		isClient:    false,
 		handler:     s,
+		goAway:      s.goAway,
+		stop:        s.stopConns,
 		exiting:     make(chan struct{}),
-	}).handleWsConn(ctx)
+
+		nativePing:   nativePing,
+		pingInterval: s.keepaliveInterval,
+		idleTimeout:  s.keepaliveTimeout,
+
+		chunkSize:      s.chunkSize,
+		maxMessageSize: s.maxRequestSize,
+		peerChunked:    func() bool { return clientChunked },
+	}
+	if !s.trackConn(wc) {
+		cmsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+		_ = c.WriteMessage(websocket.CloseMessage, cmsg)
+		_ = c.Close()
+		return
+	}
+	defer s.untrackConn(wc)
+
+	stats.Record(ctx, conns.M(1))
+	defer stats.Record(ctx, conns.M(-1))
+
+	wc.handleWsConn(ctx)
 }
 
 // TODO: return errors to clients per spec
 func (s *RPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	if s.isClosing() {
+		w.Header().Set("Connection", "close")
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	h := strings.ToLower(r.Header.Get("Connection"))
 	if strings.Contains(h, "upgrade") {
 		s.handleWS(ctx, w, r)
 		return
 	}
+	if r.Header.Get(streamHeader) != "" {
+		s.handleStream(ctx, w, r)
+		return
+	}
+
+	ctx = withHTTPSpanContext(ctx, r.Header)
+
+	if r.Method == http.MethodGet {
+		s.handleGet(ctx, w, r)
+		return
+	}
+
+	// channel-returning methods are served as server-sent events or polled
+	if strings.Contains(r.Header.Get("Accept"), eventStreamType) {
+		s.handleSSE(ctx, w, r)
+		return
+	}
 
 	erf := func(wrtfun func(interface{}), req *request, code int, err error) {
 		w.WriteHeader(500)
 		rpcError(wrtfun, req, code, err)
 	}
-	s.handleReader(ctx, r.Body, w, erf)
+	if r.Header.Get(longPollHeader) != "" {
+		s.handleLongPoll(ctx, w, r, erf)
+		return
+	}
+	s.handleReader(ctx, r.Body, w, erf, nil)
 }
 
 func rpcError(wrtfun func(interface{}), req *request, code int, err error) {
@@ -106,18 +264,13 @@ func rpcError(wrtfun func(interface{}), req *request, code int, err error) {
 		},
 	}
 
-	wrtfun(resp)
-}
-
-// Register registers new RPC handler
-//
-// Handler is any value with methods defined
-func (s *RPCServer) Register(namespace string, handler interface{}) {
-	s.register(namespace, handler)
-}
+	// invalid fields are listed in the error data
+	var verrs ValidationErrors
+	if xerrors.As(err, &verrs) {
+		resp.Error.Data, _ = json.Marshal(verrs)
+	}
 
-func (s *RPCServer) AliasMethod(alias, original string) {
-	s.aliasedMethods[alias] = original
+	wrtfun(resp)
 }
 
 var _ error = &respError{}
@@ -0,0 +1,138 @@
+package jsonrpc
+
+import (
+	"context"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown checks for in-flight calls and
+// open connections
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown gracefully stops the server. New calls and connections are
+// rejected, websocket clients are sent a notice telling them to reconnect
+// elsewhere, and in-flight calls are given time to finish. Once calls are
+// done, websocket connections are closed, which also closes their
+// subscription channels.
+//
+// If ctx expires first, remaining calls are cancelled, connections are closed
+// forcefully and ctx.Err() is returned.
+//
+// Shutdown doesn't close listeners, http.Server.Shutdown should be used for
+// that.
+func (s *RPCServer) Shutdown(ctx context.Context) error {
+	s.shutdownLk.Lock()
+	if !s.closing {
+		s.closing = true
+		close(s.goAway)
+	}
+	s.shutdownLk.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	// wait for in-flight calls
+	for s.activeCalls() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.forceClose()
+			return ctx.Err()
+		}
+	}
+
+	// close connections, and with them channel subscriptions
+	s.stopConnsOnce.Do(func() {
+		close(s.stopConns)
+	})
+
+	for s.activeConns() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.forceClose()
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (s *RPCServer) isClosing() bool {
+	s.shutdownLk.Lock()
+	defer s.shutdownLk.Unlock()
+
+	return s.closing
+}
+
+// startCall registers an in-flight call, false is returned when the server is
+// shutting down
+func (s *RPCServer) startCall(cancel context.CancelFunc) (func(), bool) {
+	s.shutdownLk.Lock()
+	defer s.shutdownLk.Unlock()
+
+	if s.closing {
+		return nil, false
+	}
+
+	id := s.callCtr
+	s.callCtr++
+	s.calls[id] = cancel
+
+	return func() {
+		s.shutdownLk.Lock()
+		defer s.shutdownLk.Unlock()
+
+		delete(s.calls, id)
+	}, true
+}
+
+func (s *RPCServer) activeCalls() int {
+	s.shutdownLk.Lock()
+	defer s.shutdownLk.Unlock()
+
+	return len(s.calls)
+}
+
+// trackConn registers a websocket connection, false is returned when the
+// server is shutting down
+func (s *RPCServer) trackConn(c *wsConn) bool {
+	s.shutdownLk.Lock()
+	defer s.shutdownLk.Unlock()
+
+	if s.closing {
+		return false
+	}
+
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *RPCServer) untrackConn(c *wsConn) {
+	s.shutdownLk.Lock()
+	defer s.shutdownLk.Unlock()
+
+	delete(s.conns, c)
+}
+
+func (s *RPCServer) activeConns() int {
+	s.shutdownLk.Lock()
+	defer s.shutdownLk.Unlock()
+
+	return len(s.conns)
+}
+
+// forceClose cancels all in-flight calls and closes all connections
+func (s *RPCServer) forceClose() {
+	s.shutdownLk.Lock()
+	defer s.shutdownLk.Unlock()
+
+	for _, cancel := range s.calls {
+		cancel()
+	}
+	for c := range s.conns {
+		if err := c.conn.Close(); err != nil {
+			log.Warnw("closing websocket connection", "error", err)
+		}
+	}
+}
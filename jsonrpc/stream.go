@@ -0,0 +1,498 @@
+package jsonrpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"gitee.com/huanghua_2017/hggutils/jsonrpc/metrics"
+	"go.opencensus.io/stats"
+	"golang.org/x/xerrors"
+)
+
+// Channel-returning methods can be called over plain HTTP. Requests accepting
+// eventStreamType get the response and channel messages as server-sent
+// events, carrying the same frames as websocket connections. Requests with
+// longPollHeader set get a channel id instead, values are then fetched with
+// pollChannelMethod calls until the channel is closed.
+const (
+	eventStreamType = "text/event-stream"
+	longPollHeader  = "X-Jsonrpc-Long-Poll"
+)
+
+const (
+	pollChannelMethod  = "xrpc.PollChannel"
+	closeChannelMethod = "xrpc.CloseChannel"
+)
+
+const (
+	// sseChanID is the channel id on event streams, which carry one channel
+	sseChanID = 1
+
+	// sseKeepaliveInterval is how often comments are sent on idle event
+	// streams, so that proxies don't time them out
+	sseKeepaliveInterval = 15 * time.Second
+
+	// longPollTimeout is how long a poll waits for channel values
+	longPollTimeout = 30 * time.Second
+	// longPollBuffer is how many values are kept for a polled channel
+	longPollBuffer = 128
+	// long-polled channels which aren't polled for longPollIdle are closed
+	longPollIdle = 2 * longPollTimeout
+)
+
+//                    //
+// Server-sent events //
+//                    //
+
+// eventWriter writes each message as a server-sent event
+type eventWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+// Write writes a JSON message as an event, JSON encoding doesn't produce
+// newlines so a single data line is enough
+func (e *eventWriter) Write(msg []byte) (int, error) {
+	if _, err := fmt.Fprintf(e.w, "data: %s\n\n", msg); err != nil {
+		return 0, err
+	}
+	e.flusher.Flush()
+	return len(msg), nil
+}
+
+func (e *eventWriter) write(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.Write(msg)
+	return err
+}
+
+func (e *eventWriter) keepalive() error {
+	if _, err := io.WriteString(e.w, ": keepalive\n\n"); err != nil {
+		return err
+	}
+	e.flusher.Flush()
+	return nil
+}
+
+func (s *RPCServer) handleSSE(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", eventStreamType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // don't let nginx buffer the stream
+	ew := &eventWriter{w: w, flusher: flusher}
+
+	// the call context ends with the request, or when the channel can't be
+	// forwarded
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var out reflect.Value
+	var method string
+	var reqID int64
+	s.handleReader(ctx, r.Body, ew, rpcError, func(m string, ch reflect.Value, id int64) error {
+		method, out, reqID = m, ch, id
+		return nil
+	})
+	if !out.IsValid() {
+		return
+	}
+
+	if err := ew.write(response{
+		Jsonrpc: "2.0",
+		ID:      reqID,
+		Result:  sseChanID,
+	}); err != nil {
+		log.Debugw("writing channel response", "error", err)
+		return
+	}
+
+	stats.Record(ctx, metrics.RPCChannels.M(1))
+	defer stats.Record(ctx, metrics.RPCChannels.M(-1))
+
+	ticker := time.NewTicker(sseKeepaliveInterval)
+	defer ticker.Stop()
+
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.stopConns)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ticker.C)},
+		{Dir: reflect.SelectRecv, Chan: out},
+	}
+
+	closeChan := func(err error) error {
+		return ew.write(request{
+			Jsonrpc: "2.0",
+			Method:  chClose,
+			Params:  chanCloseParams(sseChanID, err),
+		})
+	}
+
+	for {
+		chosen, val, ok := reflect.Select(cases)
+
+		var err error
+		switch {
+		case chosen < 2: // request done, or server shutting down
+			return
+		case chosen == 2:
+			err = ew.keepalive()
+		case !ok:
+			if err = closeChan(nil); err == nil {
+				return
+			}
+		default:
+			// a value which can't be marshaled, or panics doing so, closes
+			// the channel; returning cancels the call context
+			msg, merr := s.marshalChanValue(ctx, method, request{
+				Jsonrpc: "2.0",
+				Method:  chValue,
+				Params:  []param{{v: reflect.ValueOf(sseChanID)}, {v: val}},
+			})
+			if merr != nil {
+				if err = closeChan(merr); err == nil {
+					return
+				}
+				break
+			}
+			_, err = ew.Write(msg)
+		}
+		if err != nil {
+			log.Debugw("writing event stream", "error", err)
+			return
+		}
+	}
+}
+
+// readEvent returns the data of the next server-sent event, comments and
+// other fields are skipped
+func readEvent(r *bufio.Reader) ([]byte, error) {
+	var data []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+
+		switch {
+		case len(line) == 0:
+			if data != nil {
+				return data, nil
+			}
+		case bytes.HasPrefix(line, []byte("data:")):
+			if data != nil {
+				data = append(data, '\n')
+			} else {
+				data = []byte{}
+			}
+			data = append(data, bytes.TrimPrefix(line[len("data:"):], []byte(" "))...)
+		}
+	}
+}
+
+// readEventStream reads the response to a channel call made over HTTP with
+// server-sent events, channel messages are then read in the background until
+// the channel or the stream is closed
+func readEventStream(body io.ReadCloser, cr clientRequest) (clientResponse, error) {
+	events := bufio.NewReader(body)
+
+	data, err := readEvent(events)
+	if err != nil {
+		body.Close()
+		return clientResponse{}, xerrors.Errorf("reading event stream: %w", err)
+	}
+
+	var resp clientResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		body.Close()
+		return clientResponse{}, xerrors.Errorf("unmarshaling response: %w", err)
+	}
+	if resp.ID != *cr.req.ID || resp.Error != nil || resp.Result == nil {
+		body.Close()
+		return resp, nil
+	}
+
+	_, sink := cr.retCh()
+	go func() {
+		defer body.Close()
+
+		for {
+			data, err := readEvent(events)
+			if err != nil {
+				log.Debugw("event stream ended", "error", err)
+				sink(nil, false)
+				return
+			}
+
+			var f frame
+			if err := json.Unmarshal(data, &f); err != nil {
+				log.Errorf("failed to unmarshal channel message: %s", err)
+				continue
+			}
+
+			switch f.Method {
+			case chValue:
+				if len(f.Params) != 2 {
+					log.Errorf("%s: expected 2 params, got %d", chValue, len(f.Params))
+					continue
+				}
+				sink(f.Params[1].data, true)
+			case chClose:
+				logChanClose(f.Params)
+				sink(nil, false)
+				return
+			}
+		}
+	}()
+
+	return resp, nil
+}
+
+//           //
+// Long-poll //
+//           //
+
+// pollResult is returned from pollChannelMethod
+type pollResult struct {
+	Values []json.RawMessage
+	Closed bool
+	// Error is set when the channel was closed because a value couldn't be
+	// sent
+	Error string `json:",omitempty"`
+}
+
+type polledChan struct {
+	method string
+	values chan json.RawMessage
+	cancel context.CancelFunc
+	idle   *time.Timer
+
+	// err is the error which closed values, set before it's closed
+	err error
+}
+
+// forward buffers values from the channel until it's closed, a value can't be
+// marshaled, or the server is shutting down
+func (pc *polledChan) forward(ctx context.Context, s *RPCServer, ch reflect.Value, stop <-chan struct{}) {
+	defer close(pc.values)
+	defer pc.cancel()
+
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(stop)},
+		{Dir: reflect.SelectRecv, Chan: ch},
+	}
+
+	for {
+		chosen, val, ok := reflect.Select(cases)
+		if chosen != 2 || !ok {
+			return
+		}
+
+		data, err := s.marshalChanValue(ctx, pc.method, val.Interface())
+		if err != nil {
+			pc.err = err
+			return
+		}
+
+		select {
+		case pc.values <- data:
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		}
+	}
+}
+
+// longPoll holds channels of calls made with longPollHeader, its methods are
+// registered as pollChannelMethod and closeChannelMethod
+type longPoll struct {
+	lk    sync.Mutex
+	chans map[uint64]*polledChan
+
+	s    *RPCServer
+	stop <-chan struct{}
+}
+
+func newLongPoll(s *RPCServer) *longPoll {
+	return &longPoll{
+		chans: map[uint64]*polledChan{},
+		s:     s,
+		stop:  s.stopConns,
+	}
+}
+
+// add registers a channel, ids are random so that they can't be guessed by
+// other clients
+func (lp *longPoll) add(ctx context.Context, cancel context.CancelFunc, method string, ch reflect.Value) uint64 {
+	pc := &polledChan{
+		method: method,
+		values: make(chan json.RawMessage, longPollBuffer),
+		cancel: cancel,
+	}
+
+	lp.lk.Lock()
+	var id uint64
+	for {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			log.Errorw("generating channel id", "error", err)
+		}
+		id = binary.BigEndian.Uint64(b[:])
+		if _, ok := lp.chans[id]; !ok && id != 0 {
+			break
+		}
+	}
+	lp.chans[id] = pc
+	pc.idle = time.AfterFunc(longPollIdle, func() {
+		log.Warnw("long-polled channel not polled, closing", "id", id)
+		lp.remove(id)
+	})
+	lp.lk.Unlock()
+
+	stats.Record(ctx, metrics.RPCChannels.M(1))
+	go pc.forward(ctx, lp.s, ch, lp.stop)
+
+	return id
+}
+
+func (lp *longPoll) get(id uint64) (*polledChan, bool) {
+	lp.lk.Lock()
+	defer lp.lk.Unlock()
+
+	pc, ok := lp.chans[id]
+	return pc, ok
+}
+
+func (lp *longPoll) remove(id uint64) {
+	lp.lk.Lock()
+	pc, ok := lp.chans[id]
+	delete(lp.chans, id)
+	lp.lk.Unlock()
+
+	if !ok {
+		return
+	}
+	pc.idle.Stop()
+	pc.cancel()
+	stats.Record(context.Background(), metrics.RPCChannels.M(-1))
+}
+
+// PollChannel waits for values from a long-polled channel, returning all
+// buffered values once there are any
+func (lp *longPoll) PollChannel(ctx context.Context, id uint64) (*pollResult, error) {
+	pc, ok := lp.get(id)
+	if !ok {
+		return nil, xerrors.Errorf("channel %d not found", id)
+	}
+	pc.idle.Reset(longPollIdle)
+
+	// return before the call times out
+	wait := longPollTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if d := time.Until(deadline) * 9 / 10; d < wait {
+			wait = d
+		}
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	res := &pollResult{}
+	add := func(v json.RawMessage, ok bool) {
+		if !ok {
+			res.Closed = true
+			if pc.err != nil {
+				res.Error = pc.err.Error()
+			}
+			return
+		}
+		res.Values = append(res.Values, v)
+	}
+
+	select {
+	case v, ok := <-pc.values:
+		add(v, ok)
+	case <-timer.C:
+		return res, nil
+	case <-ctx.Done():
+		return res, nil
+	}
+
+	// take whatever else is buffered
+loop:
+	for !res.Closed && len(res.Values) < longPollBuffer {
+		select {
+		case v, ok := <-pc.values:
+			add(v, ok)
+		default:
+			break loop
+		}
+	}
+
+	if res.Closed {
+		lp.remove(id)
+	} else {
+		pc.idle.Reset(longPollIdle)
+	}
+	return res, nil
+}
+
+// CloseChannel closes a long-polled channel, cancelling the call context
+func (lp *longPoll) CloseChannel(id uint64) {
+	lp.remove(id)
+}
+
+// detachedContext keeps the values of a context, but not its cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (d detachedContext) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+func (s *RPCServer) handleLongPoll(ctx context.Context, w http.ResponseWriter, r *http.Request, rpcError rpcErrFunc) {
+	// channels outlive the request, until closed or no longer polled
+	ctx, cancel := context.WithCancel(detachedContext{ctx})
+
+	registered := false
+	s.handleReader(ctx, r.Body, w, rpcError, func(method string, ch reflect.Value, reqID int64) error {
+		registered = true
+		id := s.longPoll.add(ctx, cancel, method, ch)
+
+		// not polled channels get closed after longPollIdle, so there's no
+		// need to clean up when the response can't be written
+		msg, _ := json.Marshal(response{
+			Jsonrpc: "2.0",
+			ID:      reqID,
+			Result:  id,
+		})
+		if _, err := w.Write(msg); err != nil {
+			log.Debugw("writing channel response", "error", err)
+		}
+		return nil
+	})
+	if !registered {
+		cancel()
+	}
+}
@@ -0,0 +1,111 @@
+package jsonrpc
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// metaTimeout carries the time left until the client's context deadline, as
+// a Go duration string. A relative value is used so that clock skew between
+// the client and the server doesn't matter.
+const metaTimeout = "timeout"
+
+var errCallTimeout = xerrors.New("call deadline exceeded")
+
+type methodTimeout struct {
+	def time.Duration
+	max time.Duration
+}
+
+// callTimeout picks the timeout for a call based on the client deadline and
+// server configuration, handlerTimeout is set with the MethodTimeout register
+// option. Server-configured timeouts don't apply to methods returning
+// channels, as those would cut subscriptions short.
+func (s *RPCServer) callTimeout(method string, handlerTimeout *methodTimeout, meta map[string]string, outCh bool) (time.Duration, bool) {
+	def, max := s.defaultTimeout, s.maxTimeout
+	mt, ok := s.methodTimeouts[method]
+	if !ok && handlerTimeout != nil {
+		mt, ok = *handlerTimeout, true
+	}
+	if ok {
+		if mt.def != 0 {
+			def = mt.def
+		}
+		if mt.max != 0 {
+			max = mt.max
+		}
+	}
+	if outCh {
+		def, max = 0, 0
+	}
+
+	d, ok := def, def > 0
+	if v, found := meta[metaTimeout]; found {
+		cd, err := time.ParseDuration(v)
+		if err != nil {
+			log.Warnw("invalid call timeout", "method", method, "value", v, "error", err)
+		} else {
+			d, ok = cd, true
+		}
+	}
+
+	if max > 0 && (!ok || d > max) {
+		d, ok = max, true
+	}
+
+	return d, ok
+}
+
+// doCallTimeout is like doCall, but returns errCallTimeout as soon as the
+// context deadline is reached. The handler itself is left running, it's
+// expected to notice the cancelled context; endCall is then called once it
+// returns, so that Shutdown waits for it. Otherwise the caller calls endCall.
+func (s *RPCServer) doCallTimeout(ctx context.Context, methodName string, f reflect.Value, params []reflect.Value, endCall func()) ([]reflect.Value, error) {
+	type result struct {
+		out []reflect.Value
+		err error
+	}
+
+	// lk hands endCall over to the handler goroutine, unless the handler
+	// returned by the time the call timed out
+	var lk sync.Mutex
+	var returned, timedOut bool
+
+	rch := make(chan result, 1)
+	go func() {
+		out, err := s.doCall(ctx, methodName, f, params)
+		rch <- result{out, err}
+
+		lk.Lock()
+		returned = true
+		end := timedOut
+		lk.Unlock()
+		if end {
+			endCall()
+		}
+	}()
+
+	select {
+	case r := <-rch:
+		return r.out, r.err
+	case <-ctx.Done():
+		if ctx.Err() != context.DeadlineExceeded {
+			// cancelled by the client, wait for the handler to return
+			r := <-rch
+			return r.out, r.err
+		}
+
+		lk.Lock()
+		defer lk.Unlock()
+		if returned {
+			r := <-rch
+			return r.out, r.err
+		}
+		timedOut = true
+		return nil, errCallTimeout
+	}
+}
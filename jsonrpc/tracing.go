@@ -0,0 +1,179 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+	"go.opencensus.io/trace/tracestate"
+)
+
+// Trace context propagation keys. traceparent / tracestate follow the W3C
+// Trace Context spec (https://www.w3.org/TR/trace-context/) and are used both
+// as HTTP headers and request Meta keys. SpanContext is the legacy base64
+// encoded OpenCensus binary format, still sent for older servers.
+const (
+	metaTraceparent = "traceparent"
+	metaTracestate  = "tracestate"
+	metaSpanContext = "SpanContext"
+)
+
+type httpSpanCtxKey struct{}
+
+// withHTTPSpanContext stores trace context received in HTTP headers, it is
+// used as a fallback when the request itself doesn't carry one in Meta.
+func withHTTPSpanContext(ctx context.Context, h http.Header) context.Context {
+	sc, ok := parseTraceparent(h.Get(metaTraceparent))
+	if !ok {
+		return ctx
+	}
+	sc.Tracestate = parseTracestate(h.Get(metaTracestate))
+
+	return context.WithValue(ctx, httpSpanCtxKey{}, sc)
+}
+
+// remoteSpanContext finds the callers span context in request Meta, falling
+// back to HTTP headers
+func remoteSpanContext(ctx context.Context, meta map[string]string) (trace.SpanContext, bool) {
+	if tp, ok := meta[metaTraceparent]; ok {
+		if sc, ok := parseTraceparent(tp); ok {
+			sc.Tracestate = parseTracestate(meta[metaTracestate])
+			return sc, true
+		}
+		log.Warnw("traceparent: invalid value", "value", tp)
+	}
+
+	if eSC, ok := meta[metaSpanContext]; ok {
+		bSC, err := base64.StdEncoding.DecodeString(eSC)
+		if err != nil {
+			log.Errorw("SpanContext: decode", "error", err)
+		} else if sc, ok := propagation.FromBinary(bSC); ok {
+			return sc, true
+		} else {
+			log.Errorw("SpanContext: could not create span", "data", bSC)
+		}
+	}
+
+	sc, ok := ctx.Value(httpSpanCtxKey{}).(trace.SpanContext)
+	return sc, ok
+}
+
+// injectSpanContext writes span context into request Meta
+func injectSpanContext(meta map[string]string, sc trace.SpanContext) {
+	meta[metaTraceparent] = formatTraceparent(sc)
+	if ts := formatTracestate(sc.Tracestate); ts != "" {
+		meta[metaTracestate] = ts
+	}
+	meta[metaSpanContext] = base64.StdEncoding.EncodeToString(propagation.Binary(sc))
+}
+
+func formatTraceparent(sc trace.SpanContext) string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), uint32(sc.TraceOptions)&0xff)
+}
+
+func parseTraceparent(tp string) (trace.SpanContext, bool) {
+	var sc trace.SpanContext
+
+	parts := strings.Split(strings.TrimSpace(tp), "-")
+	if len(parts) < 4 {
+		return sc, false
+	}
+
+	ver, err := hex.DecodeString(parts[0])
+	if err != nil || len(ver) != 1 || ver[0] == 0xff {
+		return sc, false
+	}
+	if ver[0] == 0 && len(parts) != 4 {
+		return sc, false
+	}
+
+	tid, err := hex.DecodeString(parts[1])
+	if err != nil || len(tid) != len(sc.TraceID) {
+		return sc, false
+	}
+	copy(sc.TraceID[:], tid)
+
+	sid, err := hex.DecodeString(parts[2])
+	if err != nil || len(sid) != len(sc.SpanID) {
+		return sc, false
+	}
+	copy(sc.SpanID[:], sid)
+
+	opts, err := hex.DecodeString(parts[3])
+	if err != nil || len(opts) != 1 {
+		return sc, false
+	}
+	sc.TraceOptions = trace.TraceOptions(opts[0])
+
+	if sc.TraceID == (trace.TraceID{}) || sc.SpanID == (trace.SpanID{}) {
+		return sc, false
+	}
+
+	return sc, true
+}
+
+func formatTracestate(ts *tracestate.Tracestate) string {
+	if ts == nil {
+		return ""
+	}
+
+	entries := ts.Entries()
+	pairs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		pairs = append(pairs, e.Key+"="+e.Value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func parseTracestate(s string) *tracestate.Tracestate {
+	if s == "" {
+		return nil
+	}
+
+	var entries []tracestate.Entry
+	for _, member := range strings.Split(s, ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		kv := strings.SplitN(member, "=", 2)
+		if len(kv) != 2 {
+			return nil
+		}
+		entries = append(entries, tracestate.Entry{Key: kv[0], Value: kv[1]})
+	}
+
+	ts, err := tracestate.New(nil, entries...)
+	if err != nil {
+		log.Warnw("tracestate: invalid value", "value", s, "error", err)
+		return nil
+	}
+	return ts
+}
+
+// setSpanError records RPC error details on a span
+func setSpanError(span *trace.Span, code int, msg string) {
+	status := trace.StatusCodeUnknown
+	switch code {
+	case rpcMethodNotFound:
+		status = trace.StatusCodeNotFound
+	case rpcParseError, rpcInvalidParams:
+		status = trace.StatusCodeInvalidArgument
+	case rpcTimeout:
+		status = trace.StatusCodeDeadlineExceeded
+	case rpcInternalError, rpcPanic:
+		status = trace.StatusCodeInternal
+	}
+
+	span.SetStatus(trace.Status{Code: int32(status), Message: msg})
+	span.AddAttributes(
+		trace.BoolAttribute("error", true),
+		trace.Int64Attribute("error.code", int64(code)),
+		trace.StringAttribute("error.message", msg),
+	)
+}
@@ -2,6 +2,7 @@ package jsonrpc
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"math/rand"
@@ -31,6 +32,16 @@ func (p *param) MarshalJSON() ([]byte, error) {
 
 // processFuncOut finds value and error Outs in function
 func processFuncOut(funcType reflect.Type) (valOut int, errOut int, n int) {
+	valOut, errOut, n, err := funcOuts(funcType)
+	if err != nil {
+		panic(err.Error())
+	}
+	return valOut, errOut, n
+}
+
+// funcOuts is like processFuncOut, but returns an error for unsupported
+// signatures
+func funcOuts(funcType reflect.Type) (valOut int, errOut int, n int, err error) {
 	errOut = -1 // -1 if not found
 	valOut = -1
 	n = funcType.NumOut()
@@ -47,11 +58,10 @@ func processFuncOut(funcType reflect.Type) (valOut int, errOut int, n int) {
 		valOut = 0
 		errOut = 1
 		if funcType.Out(1) != errorType {
-			panic("expected error as second return value")
+			return 0, 0, 0, errors.New("expected error as second return value")
 		}
 	default:
-		errstr := fmt.Sprintf("too many return values: %s", funcType)
-		panic(errstr)
+		return 0, 0, 0, fmt.Errorf("too many return values: %s", funcType)
 	}
 
 	return
@@ -0,0 +1,243 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Validator is implemented by param types which check themselves, see
+// WithParamValidation
+type Validator interface {
+	Validate() error
+}
+
+var validatorType = reflect.TypeOf(new(Validator)).Elem()
+
+// FieldError describes an invalid field of a call param
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists invalid fields, Validate methods can return it to
+// report more than one field. Calls failing validation return it as the error
+// data, see FieldErrors.
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, fe := range v {
+		if fe.Field == "" {
+			msgs[i] = fe.Message
+		} else {
+			msgs[i] = fe.Field + ": " + fe.Message
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// FieldErrors returns the invalid fields reported by the server, for calls
+// which failed param validation
+func FieldErrors(err error) []FieldError {
+	var rerr *respError
+	if !xerrors.As(err, &rerr) || rerr.Code != rpcInvalidParams || len(rerr.Data) == 0 {
+		return nil
+	}
+
+	var fields []FieldError
+	if err := json.Unmarshal(rerr.Data, &fields); err != nil {
+		return nil
+	}
+	return fields
+}
+
+// validateParam checks a decoded param with its Validate method and
+// `validate` struct tags, field names are prefixed with path
+func validateParam(path string, v reflect.Value) ValidationErrors {
+	var errs ValidationErrors
+	validateValue(path, v, &errs)
+	return errs
+}
+
+func validateValue(path string, v reflect.Value, errs *ValidationErrors) {
+	if !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil()) {
+		return
+	}
+
+	// values from ParamDecoders and map elements aren't addressable, copy them
+	// so that Validate methods with pointer receivers are called too
+	if v.Kind() != reflect.Ptr && !v.CanAddr() {
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		v = c
+	}
+
+	if v.CanInterface() {
+		if val, ok := v.Interface().(Validator); ok {
+			addValidateError(path, val.Validate(), errs)
+		} else if v.Kind() != reflect.Ptr {
+			if val, ok := v.Addr().Interface().(Validator); ok {
+				addValidateError(path, val.Validate(), errs)
+			}
+		}
+	}
+
+	v = reflect.Indirect(v)
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" { // unexported
+				continue
+			}
+
+			fpath := path + "." + jsonFieldName(f)
+			fv := v.Field(i)
+			if tag := f.Tag.Get("validate"); tag != "" {
+				for _, msg := range checkTag(fv, tag) {
+					*errs = append(*errs, FieldError{Field: fpath, Message: msg})
+				}
+			}
+			validateValue(fpath, fv, errs)
+		}
+	case reflect.Slice, reflect.Array:
+		if !mayValidate(v.Type().Elem()) {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			validateValue(fmt.Sprintf("%s[%d]", path, i), v.Index(i), errs)
+		}
+	case reflect.Map:
+		if !mayValidate(v.Type().Elem()) {
+			return
+		}
+		// sorted, so that errors are reported in the same order every time
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		for _, k := range keys {
+			validateValue(fmt.Sprintf("%s[%v]", path, k), v.MapIndex(k), errs)
+		}
+	}
+}
+
+// mayValidate checks if values of a type, as slice or map elements, can have
+// anything to validate
+func mayValidate(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct || t.Kind() == reflect.Ptr || reflect.PtrTo(t).Implements(validatorType)
+}
+
+func addValidateError(path string, err error, errs *ValidationErrors) {
+	if err == nil {
+		return
+	}
+
+	var verrs ValidationErrors
+	if xerrors.As(err, &verrs) {
+		for _, fe := range verrs {
+			if fe.Field == "" {
+				fe.Field = path
+			} else {
+				fe.Field = path + "." + fe.Field
+			}
+			*errs = append(*errs, fe)
+		}
+		return
+	}
+	*errs = append(*errs, FieldError{Field: path, Message: err.Error()})
+}
+
+func jsonFieldName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return f.Name
+	}
+	return name
+}
+
+// checkTag checks a value against rules of a `validate` tag, like
+// `validate:"required,min=1,max=10"`. Supported rules:
+//
+//	required     value must not be the zero value
+//	min=n, max=n bounds of numbers, or of the length of strings, slices and maps
+//	oneof=a b c  value must be one of the space-separated values
+func checkTag(v reflect.Value, tag string) []string {
+	var msgs []string
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, arg = rule[:i], rule[i+1:]
+		}
+
+		switch name {
+		case "required":
+			if v.IsZero() {
+				msgs = append(msgs, "required")
+			}
+		case "min", "max":
+			bound, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				msgs = append(msgs, fmt.Sprintf("invalid %s rule: %s", name, arg))
+				continue
+			}
+			n, isLen, ok := measure(v)
+			if !ok {
+				continue
+			}
+			what := "value"
+			if isLen {
+				what = "length"
+			}
+			if name == "min" && n < bound {
+				msgs = append(msgs, fmt.Sprintf("%s must be at least %s", what, arg))
+			}
+			if name == "max" && n > bound {
+				msgs = append(msgs, fmt.Sprintf("%s must be at most %s", what, arg))
+			}
+		case "oneof":
+			iv := reflect.Indirect(v)
+			if !iv.IsValid() {
+				continue
+			}
+			s := fmt.Sprint(iv.Interface())
+			found := false
+			for _, opt := range strings.Fields(arg) {
+				if s == opt {
+					found = true
+					break
+				}
+			}
+			if !found {
+				msgs = append(msgs, fmt.Sprintf("must be one of: %s", arg))
+			}
+		case "":
+		default:
+			msgs = append(msgs, fmt.Sprintf("unknown validation rule '%s'", name))
+		}
+	}
+	return msgs
+}
+
+// measure returns the number checked by min and max rules
+func measure(v reflect.Value) (n float64, isLen bool, ok bool) {
+	v = reflect.Indirect(v)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), false, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), false, true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), false, true
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return float64(v.Len()), true, true
+	}
+	return 0, false, false
+}
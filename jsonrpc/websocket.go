@@ -3,12 +3,17 @@ package jsonrpc
 import (
 	"context"
 	"encoding/json"
+	"net"
 	"reflect"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"gitee.com/huanghua_2017/hggutils/jsonrpc/metrics"
 	"github.com/gorilla/websocket"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
 	"golang.org/x/xerrors"
 )
 
@@ -17,6 +22,17 @@ const chValue = "xrpc.ch.val"
 const chClose = "xrpc.ch.close"
 const wsPing = "xrpc.ping"
 const wsPong = "xrpc.pong"
+const wsGoAway = "xrpc.goaway"
+
+// pingWriteWait bounds writing control frames
+const pingWriteWait = 10 * time.Second
+
+// closedChan is always ready to receive from
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
 
 type frame struct {
 	// common
@@ -31,35 +47,93 @@ type frame struct {
 	// response
 	Result json.RawMessage `json:"result,omitempty"`
 	Error  *respError      `json:"error,omitempty"`
+
+	// size of the raw message, for metrics
+	size int
 }
 
 type outChanReg struct {
-	reqID int64
+	reqID  int64
+	method string
+	// cancel cancels the context of the call which returned the channel
+	cancel context.CancelFunc
 
 	chID uint64
 	ch   reflect.Value
 }
 
+// msgConn is a message-based connection, either a websocket connection or an
+// HTTP/2 stream carrying messages as lines, see streamConn
+type msgConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetReadLimit(limit int64)
+	SetPongHandler(h func(appData string) error)
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+var _ msgConn = (*websocket.Conn)(nil)
+
 type wsConn struct {
 	// outside params
-	conn             *websocket.Conn
-	connFactory      func() (*websocket.Conn, error)
+	conn             msgConn
+	connFactory      func() (msgConn, error)
 	reconnectBackoff backoff
 	pingInterval     time.Duration
 	timeout          time.Duration
 	noReConnect      bool
 	handler          *RPCServer
 	requests         <-chan clientRequest
-	frameChan        chan frame
 
 	isClient bool
-	isStoped bool
 	stop     <-chan struct{}
 	exiting  chan struct{}
 
-	//
-	writeChan     chan []byte
-	keepAliveChan chan []byte
+	// keepalive; the connection is closed when nothing is received for
+	// idleTimeout. Native pings use websocket control frames instead of
+	// xrpc.ping messages.
+	nativePing  bool
+	idleTimeout time.Duration
+	// rtt is the last measured ping round-trip time in nanoseconds, pingSent
+	// is when the pending xrpc.ping was sent
+	rtt      int64
+	pingSent time.Time
+
+	// large calls and responses are split into chunks of chunkSize when the
+	// peer accepts chunked messages, peerChunked is checked on each connect.
+	// Incoming messages, chunked or not, are limited to maxMessageSize.
+	chunkSize      int
+	maxMessageSize int64
+	peerChunked    func() bool
+	sendChunked    bool
+	// chunked are outgoing messages being written in chunks
+	chunked  []*chunkedMessage
+	chunkCtr uint64
+
+	// client connection state
+	status               *ConnStatus
+	maxReconnectAttempts int
+	// offline holds client calls made while reconnecting, in-flight calls
+	// with the replay policy are put back into it when the connection is lost
+	offline *offlineQueue
+
+	// goAway is closed by the server when shutting down, a notice is sent to
+	// the client which will reconnect without delay once the connection closes
+	goAway    <-chan struct{}
+	goingAway bool
+
+	// writeChan queues messages from other goroutines, they are written by
+	// the connection loop
+	writeChan chan outMessage
+	// writeErr is the first error writing to the current connection, it ends
+	// the connection loop
+	writeErr error
+
+	// inflight, chanHandlers and handling are owned by the connection loop,
+	// other goroutines must not touch them
 
 	// ////
 	// Client related
@@ -74,8 +148,9 @@ type wsConn struct {
 	// Server related
 
 	// handling are the calls we handle
-	handling   map[int64]context.CancelFunc
-	handlingLk sync.Mutex
+	handling map[int64]context.CancelFunc
+	// callDone receives IDs of handled calls which finished
+	callDone chan int64
 
 	spawnOutChanHandlerOnce sync.Once
 
@@ -85,6 +160,12 @@ type wsConn struct {
 	registerCh chan outChanReg
 }
 
+func (c *wsConn) setState(state ConnState, reason error) {
+	if c.status != nil {
+		c.status.set(state, reason)
+	}
+}
+
 //                 //
 // Output channels //
 //                 //
@@ -106,7 +187,35 @@ func (c *wsConn) handleOutChans() {
 		},
 	}
 	internal := len(cases)
-	var caseToID []uint64
+	var caseToChan []outChanReg
+
+	defer func() {
+		stats.Record(context.Background(), metrics.RPCChannels.M(-int64(len(caseToChan))))
+	}()
+
+	// closeOut stops forwarding the channel of a case, and tells remote that
+	// it's closed, with the error which closed it if any
+	closeOut := func(chosen int, err error) {
+		id := caseToChan[chosen-internal].chID
+
+		n := len(cases) - 1
+		if n > 0 {
+			cases[chosen] = cases[n]
+			caseToChan[chosen-internal] = caseToChan[n-internal]
+		}
+
+		cases = cases[:n]
+		caseToChan = caseToChan[:n-internal]
+		stats.Record(context.Background(), metrics.RPCChannels.M(-1))
+
+		msg, _ := json.Marshal(request{
+			Jsonrpc: "2.0",
+			ID:      nil, // notification
+			Method:  chClose,
+			Params:  chanCloseParams(id, err),
+		})
+		c.send(msg, false)
+	}
 
 	for {
 		chosen, val, ok := reflect.Select(cases)
@@ -122,18 +231,19 @@ func (c *wsConn) handleOutChans() {
 
 			registration := val.Interface().(outChanReg)
 
-			caseToID = append(caseToID, registration.chID)
+			caseToChan = append(caseToChan, registration)
 			cases = append(cases, reflect.SelectCase{
 				Dir:  reflect.SelectRecv,
 				Chan: registration.ch,
 			})
+			stats.Record(context.Background(), metrics.RPCChannels.M(1))
 
 			msg, _ := json.Marshal(response{
 				Jsonrpc: "2.0",
 				ID:      registration.reqID,
 				Result:  registration.chID,
 			})
-			c.writeChan <- msg
+			c.send(msg, false)
 
 			continue
 		case 1: // exiting channel
@@ -151,41 +261,31 @@ func (c *wsConn) handleOutChans() {
 
 		if !ok {
 			// Output channel closed, cleanup, and tell remote that this happened
-
-			id := caseToID[chosen-internal]
-
-			n := len(cases) - 1
-			if n > 0 {
-				cases[chosen] = cases[n]
-				caseToID[chosen-internal] = caseToID[n-internal]
-			}
-
-			cases = cases[:n]
-			caseToID = caseToID[:n-internal]
-
-			msg, _ := json.Marshal(request{
-				Jsonrpc: "2.0",
-				ID:      nil, // notification
-				Method:  chClose,
-				Params:  []param{{v: reflect.ValueOf(id)}},
-			})
-			c.writeChan <- msg
+			closeOut(chosen, nil)
 			continue
 		}
 
-		// forward message
-		msg, _ := json.Marshal(request{
+		// forward message. Values are marshaled here, a value which can't be
+		// marshaled, or panics doing so, only closes the channel which sent it.
+		out := caseToChan[chosen-internal]
+		msg, err := c.handler.marshalChanValue(context.Background(), out.method, request{
 			Jsonrpc: "2.0",
 			ID:      nil, // notification
 			Method:  chValue,
-			Params:  []param{{v: reflect.ValueOf(caseToID[chosen-internal])}, {v: val}},
+			Params:  []param{{v: reflect.ValueOf(out.chID)}, {v: val}},
 		})
-		c.writeChan <- msg
+		if err != nil {
+			// the producer may be blocked sending the next value
+			out.cancel()
+			closeOut(chosen, err)
+			continue
+		}
+		c.send(msg, false)
 	}
 }
 
 // handleChanOut registers output channel for forwarding to client
-func (c *wsConn) handleChanOut(ch reflect.Value, req int64) error {
+func (c *wsConn) handleChanOut(method string, ch reflect.Value, req int64, cancel context.CancelFunc) error {
 	c.spawnOutChanHandlerOnce.Do(func() {
 		go c.handleOutChans()
 	})
@@ -193,7 +293,9 @@ func (c *wsConn) handleChanOut(ch reflect.Value, req int64) error {
 
 	select {
 	case c.registerCh <- outChanReg{
-		reqID: req,
+		reqID:  req,
+		method: method,
+		cancel: cancel,
 
 		chID: id,
 		ch:   ch,
@@ -221,7 +323,7 @@ func (c *wsConn) handleCtxAsync(actx context.Context, id int64) {
 		Method:  wsCancel,
 		Params:  []param{{v: reflect.ValueOf(id)}},
 	})
-	c.writeChan <- msg
+	c.send(msg, false)
 }
 
 // cancelCtx is a built-in rpc which handles context cancellation over rpc
@@ -236,9 +338,6 @@ func (c *wsConn) cancelCtx(req frame) {
 		return
 	}
 
-	c.handlingLk.Lock()
-	defer c.handlingLk.Unlock()
-
 	cf, ok := c.handling[id]
 	if ok {
 		cf()
@@ -265,6 +364,30 @@ func (c *wsConn) handleChanMessage(frame frame) {
 	hnd(frame.Params[1].data, true)
 }
 
+// chanCloseParams returns params of a chClose message, with the error which
+// closed the channel, if any
+func chanCloseParams(id interface{}, err error) []param {
+	params := []param{{v: reflect.ValueOf(id)}}
+	if err != nil {
+		params = append(params, param{v: reflect.ValueOf(err.Error())})
+	}
+	return params
+}
+
+// logChanClose logs the error a channel was closed with by the server, from
+// the params of a chClose message
+func logChanClose(params []param) {
+	if len(params) < 2 {
+		return
+	}
+	var msg string
+	if err := json.Unmarshal(params[1].data, &msg); err != nil {
+		log.Errorf("%s: failed to unmarshal error: %s", chClose, err)
+		return
+	}
+	log.Errorw("channel closed by the server", "error", msg)
+}
+
 func (c *wsConn) handleChanClose(frame frame) {
 	var chid uint64
 	if err := json.Unmarshal(frame.Params[0].data, &chid); err != nil {
@@ -280,6 +403,7 @@ func (c *wsConn) handleChanClose(frame frame) {
 
 	delete(c.chanHandlers, chid)
 
+	logChanClose(frame.Params)
 	hnd(nil, false)
 }
 
@@ -308,6 +432,7 @@ func (c *wsConn) handleResponse(frame frame) {
 		Result:  frame.Result,
 		ID:      *frame.ID,
 		Error:   frame.Error,
+		Meta:    frame.Meta,
 	}
 	delete(c.inflight, *frame.ID)
 }
@@ -327,6 +452,8 @@ func (c *wsConn) handleCall(ctx context.Context, frame frame) {
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
+	ctx, _ = tag.New(ctx, tag.Upsert(metrics.RPCMethod, frame.Method))
+	stats.Record(ctx, metrics.RPCRequestSize.M(int64(frame.size)))
 
 	nextWriter := func(interface{}) {
 		//
@@ -339,25 +466,28 @@ func (c *wsConn) handleCall(ctx context.Context, frame frame) {
 	if frame.ID != nil {
 		nextWriter = func(v interface{}) {
 			msg, _ := json.Marshal(v)
-			c.writeChan <- msg
+			stats.Record(ctx, metrics.RPCResponseSize.M(int64(len(msg))))
+			c.send(msg, true)
 		}
 
-		c.handlingLk.Lock()
-		c.handling[*frame.ID] = cancel
-		c.handlingLk.Unlock()
+		id := *frame.ID
+		c.handling[id] = cancel
 
 		done = func(keepctx bool) {
-			c.handlingLk.Lock()
-			defer c.handlingLk.Unlock()
-
 			if !keepctx {
 				cancel()
-				delete(c.handling, *frame.ID)
+				select {
+				case c.callDone <- id:
+				case <-c.exiting:
+				}
 			}
 		}
 	}
 
-	go c.handler.handle(ctx, req, nextWriter, rpcError, done, c.handleChanOut)
+	chOut := func(method string, ch reflect.Value, reqID int64) error {
+		return c.handleChanOut(method, ch, reqID, cancel)
+	}
+	go c.handler.handle(ctx, req, nextWriter, rpcError, done, chOut)
 }
 
 // handleFrame handles all incoming messages (calls and responses)
@@ -372,16 +502,21 @@ func (c *wsConn) handleFrame(ctx context.Context, frame frame) {
 	case wsCancel:
 		c.cancelCtx(frame)
 	case wsPing:
-		msg, _ := json.Marshal(request{
+		c.write(request{
 			Jsonrpc: "2.0",
 			Method:  wsPong,
 			Params:  []param{{v: reflect.ValueOf(time.Now().Format(time.RFC3339))}},
 		})
-		c.keepAliveChan <- msg
 		//log.Infow("ping", "remote", c.conn.RemoteAddr().String(), "time", frame.Params)
 	case wsPong:
 		//log.Infow("pong", "remote", c.conn.RemoteAddr().String(), "time", frame.Params)
-		return
+		if !c.pingSent.IsZero() {
+			c.recordRTT(time.Since(c.pingSent))
+			c.pingSent = time.Time{}
+		}
+	case wsGoAway:
+		log.Infow("server is going away", "remote", c.conn.RemoteAddr().String())
+		c.goingAway = true
 	case chValue:
 		c.handleChanMessage(frame)
 	case chClose:
@@ -391,8 +526,16 @@ func (c *wsConn) handleFrame(ctx context.Context, frame frame) {
 	}
 }
 
-func (c *wsConn) closeInFlight() {
+// closeInFlight fails requests waiting for a response and cancels calls we
+// handle. With replay set, requests with the replay policy are put back into
+// the offline queue instead of failing.
+func (c *wsConn) closeInFlight(replay bool) {
+	var requeue []clientRequest
 	for id, req := range c.inflight {
+		if replay && req.offline == OfflineReplay && c.offline != nil {
+			requeue = append(requeue, req)
+			continue
+		}
 		req.ready <- clientResponse{
 			Jsonrpc: "2.0",
 			ID:      id,
@@ -403,11 +546,15 @@ func (c *wsConn) closeInFlight() {
 		}
 	}
 
-	c.handlingLk.Lock()
+	if len(requeue) > 0 {
+		for _, req := range c.offline.requeue(requeue) {
+			failOffline(req)
+		}
+	}
+
 	for _, cancel := range c.handling {
 		cancel()
 	}
-	c.handlingLk.Unlock()
 
 	c.inflight = map[int64]clientRequest{}
 	c.handling = map[int64]context.CancelFunc{}
@@ -421,130 +568,314 @@ func (c *wsConn) closeChans() {
 	}
 }
 
+// outMessage is a message queued for writing. Chunkable messages may be split
+// into chunks and overtaken by other messages, which is fine for calls and
+// responses, but not for channel messages, which must stay in order.
+type outMessage struct {
+	data      []byte
+	chunkable bool
+}
+
+// send queues a message to be written by the connection loop, it's safe to
+// call from any goroutine
+func (c *wsConn) send(msg []byte, chunkable bool) {
+	select {
+	case c.writeChan <- outMessage{data: msg, chunkable: chunkable}:
+	case <-c.exiting:
+	}
+}
+
+// write writes a message to the current connection, it must only be called
+// from the connection loop. Errors are kept in writeErr.
+func (c *wsConn) write(v interface{}) {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		log.Errorw("marshaling websocket message", "error", err)
+		return
+	}
+	c.writeMsg(msg, false)
+}
+
+// writeMsg writes a message, or queues it to be written in chunks when it's
+// large and the peer accepts chunked messages
+func (c *wsConn) writeMsg(msg []byte, chunkable bool) {
+	if c.writeErr != nil {
+		return
+	}
+	if chunkable && c.sendChunked && len(msg) > c.chunkSize {
+		c.chunkCtr++
+		c.chunked = append(c.chunked, &chunkedMessage{id: c.chunkCtr, data: msg})
+		return
+	}
+	c.writeErr = c.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// writeChunk writes a chunk of the first pending chunked message, which then
+// goes to the back of the line, so that large messages share the connection
+func (c *wsConn) writeChunk() {
+	m := c.chunked[0]
+	c.chunked = c.chunked[1:]
+
+	chunk, done := m.next(c.chunkSize)
+	if !done {
+		c.chunked = append(c.chunked, m)
+	}
+	if c.writeErr == nil {
+		c.writeErr = c.conn.WriteMessage(websocket.BinaryMessage, chunk)
+	}
+}
+
+// ping sends a keepalive ping. Native pings carry the send time, which comes
+// back in the pong.
+func (c *wsConn) ping() {
+	now := time.Now()
+	if !c.nativePing {
+		c.pingSent = now
+		c.write(request{
+			Jsonrpc: "2.0",
+			Method:  wsPing,
+			Params:  []param{{v: reflect.ValueOf(now.Format(time.RFC3339))}},
+		})
+		return
+	}
+
+	if c.writeErr != nil {
+		return
+	}
+	data := strconv.FormatInt(now.UnixNano(), 10)
+	c.writeErr = c.conn.WriteControl(websocket.PingMessage, []byte(data), now.Add(pingWriteWait))
+}
+
+// handlePong is called from the reader goroutine for pong control frames
+func (c *wsConn) handlePong(conn msgConn, data string) error {
+	if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+		c.recordRTT(time.Since(time.Unix(0, sent)))
+	}
+	return c.extendDeadline(conn)
+}
+
+func (c *wsConn) recordRTT(rtt time.Duration) {
+	atomic.StoreInt64(&c.rtt, int64(rtt))
+	if c.status != nil {
+		c.status.setRTT(rtt)
+	}
+	stats.Record(context.Background(), metrics.RPCWebsocketRTT.M(float64(rtt)/float64(time.Millisecond)))
+}
+
+func (c *wsConn) extendDeadline(conn msgConn) error {
+	if c.idleTimeout <= 0 {
+		return nil
+	}
+	return conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+}
+
+// handleWsConn runs the connection until it's closed. Client connections which
+// fail are re-established with backoff, unless reconnecting is disabled.
+//
+// Each connection is served by runConn, a single loop owning all connection
+// state, and a reader goroutine passing incoming frames to it. Once the loop
+// returns, pending calls are cleaned up here, before a new connection is made.
 func (c *wsConn) handleWsConn(ctx context.Context) {
 	c.inflight = map[int64]clientRequest{}
 	c.handling = map[int64]context.CancelFunc{}
 	c.chanHandlers = map[uint64]func(m []byte, ok bool){}
-	c.writeChan = make(chan []byte, 100)
-	c.keepAliveChan = make(chan []byte, 100)
+	c.callDone = make(chan int64)
+	c.writeChan = make(chan outMessage, 100)
 	c.registerCh = make(chan outChanReg)
-	c.frameChan = make(chan frame, 100)
-	exitCh := make(chan struct{})
-
-	bretry := !c.noReConnect
-	var once sync.Once
-	exitfun := func() {
-		close(exitCh)
-		if bretry && c.isClient {
-			go func() {
-				for attempts := 0; !c.isStoped; attempts++ {
-					time.Sleep(time.Second * time.Duration(attempts+1))
-					conn, err := c.connFactory()
-					log.Infow("websocket connection retry", "error", err)
-					if err != nil {
-						continue
-					}
-					c.conn = conn
-					c.handleWsConn(ctx)
-					return
-				}
-				close(c.exiting)
-			}()
-		} else {
-			close(c.exiting)
+
+	ctx = context.WithValue(ctx, wsConnKey{}, c)
+
+	for {
+		if c.isClient {
+			c.setState(StateConnected, nil)
 		}
-	}
 
-	// ////
+		reason, retry := c.runConn(ctx)
+		retry = retry && c.isClient && !c.noReConnect
+		_ = c.conn.Close()
 
-	// on close, make sure to return from all pending calls, and cancel context
-	//  on all calls we handle
-	defer c.closeInFlight()
-	defer c.closeChans()
-	defer c.conn.Close()
-
-	// 发送消息的协程
-	go func() {
-		var ptmr <-chan time.Time
-		if c.pingInterval > 0 && c.isClient {
-			ptmr = time.NewTicker(c.pingInterval).C
+		if retry {
+			c.setState(StateReconnecting, reason)
 		}
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-exitCh:
-				return
-			case <-ptmr:
-				msg, _ := json.Marshal(request{
-					Jsonrpc: "2.0",
-					Method:  wsPing,
-					Params:  []param{{v: reflect.ValueOf(time.Now().Format(time.RFC3339))}},
-				})
-				c.keepAliveChan <- msg
-			case data := <-c.keepAliveChan:
-				err := c.conn.WriteMessage(websocket.TextMessage, data)
-				if err != nil {
-					log.Errorf("write ping pong message error, %v, %v", c.conn.RemoteAddr(), err)
-					once.Do(exitfun)
-					return
-				}
-				//log.Infow("send", "remote", c.conn.RemoteAddr().String(), "data", string(data))
-			case data := <-c.writeChan:
-				err := c.conn.WriteMessage(websocket.TextMessage, data)
-				if err != nil {
-					log.Errorf("write message error, %v, %v", c.conn.RemoteAddr(), err)
-					once.Do(exitfun)
-					return
-				}
-			case req := <-c.requests:
-				if req.req.ID != nil {
-					c.inflight[*req.req.ID] = req
-				}
-				msg, _ := json.Marshal(req.req)
-				c.writeChan <- msg
-			case fm := <-c.frameChan:
-				c.handleFrame(ctx, fm)
-			case <-c.stop:
-				cmsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "stop")
-				if err := c.conn.WriteMessage(websocket.CloseMessage, cmsg); err != nil {
-					log.Warn("failed to write close message: ", err)
-				}
-				bretry = false
-				once.Do(exitfun)
-				return
+
+		// on close, make sure to return from all pending calls, and cancel
+		// context on all calls we handle
+		c.closeInFlight(retry)
+		c.closeChans()
+
+		if retry {
+			conn, err := c.reconnect(reason)
+			if err == nil {
+				c.conn = conn
+				stats.Record(ctx, metrics.RPCClientReconnects.M(1))
+				continue
 			}
+			reason = err
+		}
+
+		c.setState(StateClosed, reason)
+		close(c.exiting)
+		return
+	}
+}
+
+// reconnect dials a new connection, waiting with backoff between attempts. It
+// gives up when the client is stopped or runs out of attempts.
+func (c *wsConn) reconnect(reason error) (msgConn, error) {
+	for attempts := 0; ; attempts++ {
+		if c.maxReconnectAttempts > 0 && attempts >= c.maxReconnectAttempts {
+			return nil, xerrors.Errorf("giving up after %d reconnect attempts: %w", attempts, reason)
+		}
+
+		delay := c.reconnectBackoff.next(attempts)
+		if attempts == 0 && c.goingAway {
+			// reconnect right away when the server asked us to go elsewhere
+			delay = 0
+		}
+		select {
+		case <-time.After(delay):
+		case <-c.stop:
+			return nil, reason
+		}
+
+		conn, err := c.connFactory()
+		log.Infow("websocket connection retry", "error", err)
+		if err != nil {
+			reason = err
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// runConn is the event loop of a single connection. It's the only goroutine
+// writing to the connection and touching inflight, handling and chanHandlers.
+// retry is true when the connection was lost, rather than closed on purpose.
+func (c *wsConn) runConn(ctx context.Context) (reason error, retry bool) {
+	frames := make(chan frame)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	conn := c.conn
+	if c.maxMessageSize > 0 {
+		conn.SetReadLimit(c.maxMessageSize)
+	}
+	conn.SetPongHandler(func(data string) error {
+		return c.handlePong(conn, data)
+	})
+	go c.readFrames(conn, frames, readErr, done)
+
+	var ping <-chan time.Time
+	if c.pingInterval > 0 {
+		ticker := time.NewTicker(c.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	goAway := c.goAway
+	c.goingAway = false
+	c.writeErr = nil
+	c.chunked = nil
+	c.sendChunked = c.chunkSize > 0 && c.peerChunked != nil && c.peerChunked()
+
+	for c.writeErr == nil {
+		// write chunks of large messages whenever nothing else is ready
+		var nextChunk <-chan struct{}
+		if len(c.chunked) > 0 {
+			nextChunk = closedChan
 		}
-	}()
 
-	for {
 		select {
 		case <-ctx.Done():
+			return ctx.Err(), false
+		case <-ping:
+			c.ping()
+		case <-nextChunk:
+			c.writeChunk()
+		case msg := <-c.writeChan:
+			c.writeMsg(msg.data, msg.chunkable)
+		case req := <-c.requests:
+			if req.req.ID != nil {
+				c.inflight[*req.req.ID] = req
+			}
+			msg, err := json.Marshal(req.req)
+			if err != nil {
+				log.Errorw("marshaling request", "error", err)
+				continue
+			}
+			c.writeMsg(msg, req.req.ID != nil)
+		case id := <-c.callDone:
+			delete(c.handling, id)
+		case fm := <-frames:
+			c.handleFrame(ctx, fm)
+		case err := <-readErr:
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return err, false
+			}
+			log.Errorf("read message error, %v, %v", c.conn.RemoteAddr(), err)
+			return err, true
+		case <-goAway:
+			goAway = nil
+			c.write(request{
+				Jsonrpc: "2.0",
+				Method:  wsGoAway,
+			})
+		case <-c.stop:
+			cmsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "stop")
+			if !c.isClient {
+				cmsg = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+			}
+			if err := c.conn.WriteMessage(websocket.CloseMessage, cmsg); err != nil {
+				log.Warn("failed to write close message: ", err)
+			}
+			return nil, false
+		}
+	}
+
+	log.Errorf("write message error, %v, %v", c.conn.RemoteAddr(), c.writeErr)
+	return c.writeErr, true
+}
+
+// readFrames reads messages from conn until it fails, passing them to the
+// connection loop
+func (c *wsConn) readFrames(conn msgConn, frames chan<- frame, readErr chan<- error, done <-chan struct{}) {
+	chunks := newChunkAssembler(c.maxMessageSize)
+	for {
+		if err := c.extendDeadline(conn); err != nil {
+			readErr <- err
 			return
-		case <-exitCh:
+		}
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			readErr <- err
 			return
-		default:
-			if c.pingInterval > 0 {
-				c.conn.SetReadDeadline(time.Now().Add(c.pingInterval * 3))
-			}
-			_, data, err := c.conn.ReadMessage()
+		}
+
+		if typ == websocket.BinaryMessage {
+			data, err = chunks.add(data)
 			if err != nil {
-				if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-					log.Errorf("read message error, %v, %v", c.conn.RemoteAddr(), err)
-				} else {
-					bretry = false
-				}
-				once.Do(exitfun)
+				cmsg := websocket.FormatCloseMessage(websocket.CloseMessageTooBig, err.Error())
+				_ = conn.WriteControl(websocket.CloseMessage, cmsg, time.Now().Add(pingWriteWait))
+				readErr <- err
 				return
 			}
-
-			var frame frame
-			if err := json.Unmarshal(data, &frame); err != nil {
-				log.Error("handle me:", err)
+			if data == nil {
 				continue
 			}
+		}
 
-			c.frameChan <- frame
+		var frame frame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			log.Error("handle me:", err)
+			continue
+		}
+		frame.size = len(data)
+
+		select {
+		case frames <- frame:
+		case <-done:
+			return
 		}
 	}
 }